@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// account is a Telegram account served by telegramfs, with its own tdlib
+// client, tdlib database directory, Bolt database, and file system tree.
+// Unless noted otherwise, its fields are only accessed by the goroutine
+// handling its Telegram events (see run), and at startup.
+type account struct {
+	name    string // The top-level directory, empty if served at the root.
+	conf    tgAccountConfig
+	dataDir string // Where the tdlib and Bolt databases are.
+
+	// The Telegram client (from tdlib). It is replaced after tdlib closes it
+	// (see recreateClient), so clientMu must be held to use it, except in run.
+	clientMu sync.RWMutex
+	client   unsafe.Pointer
+
+	// The Bolt database for persistence, divided into buckets.
+	database *bolt.DB
+
+	// The root node of the account's file system tree, and its message files.
+	root       *srv.File
+	msgNodesMu sync.Mutex
+	msgNodes   map[int64]*messageOps
+	seconds    messageSeconds // Guarded by msgNodesMu too (see names.go).
+
+	// The ids of the messages of each chat, guarded by msgNodesMu (see
+	// unread.go).
+	chatMessages map[int64]*chatMessageIDs
+
+	// The chat directories, by chat id, and the forum topic directories (see
+	// topics.go), both guarded by chatDirsMu.
+	chatDirsMu sync.Mutex
+	chatDirs   map[int64]*srv.File
+	topicDirs  map[topicKey]*srv.File
+
+	// Date layouts of chat and topic directories (see layout.go).
+	layouts map[*srv.File]*dateLayout
+
+	// Read states of chats, and the "unread" file of the root, listing the
+	// chats with unread messages (see unread.go).
+	readStates map[int64]*readState
+	rootUnread *nodes.TextFile
+
+	// The stream served by the "events" file of the root (see events.go).
+	events *nodes.Stream
+
+	// The stream of callback queries served by "bot/events" (see bot.go).
+	callbacks *nodes.Stream
+
+	// The pinned messages of chats (see pinned.go).
+	pinnedIDs map[int64]map[int64]bool
+
+	// The "state" files of secret chat directories (see secret.go).
+	secretStates map[int64]*nodes.TextFile
+
+	// The files in the "scheduled" directories of chats, by message id (see
+	// schedule.go).
+	scheduledMu    sync.Mutex
+	scheduledFiles map[int64]*srv.File
+
+	// The "users" directory and its subdirectories (see users.go).
+	usersDir *srv.File
+	userDirs map[int64]*srv.File
+
+	// The "auth/state" and "auth/qr" files (see auth.go).
+	authState *nodes.TextFile
+	authQR    *nodes.TextFile
+
+	// Whether tdlib is logging out, until its client is closed (see
+	// recreateClient).
+	loggingOut bool
+
+	// The state of tdlib, as relevant to sending messages (see outbox.go), and
+	// as shown by the "status" file (see status.go).
+	outboxMu      sync.Mutex
+	connected     bool   // Whether tdlib is connected to Telegram.
+	authorized    bool   // Whether tdlib is authorized.
+	authorization string // The authorization state, e.g., "wait-code".
+	connection    string // The connection state, e.g., "connecting".
+	statusFile    *nodes.TextFile
+
+	// The outbox entries given to tdlib, whose response we are waiting for,
+	// with the "@extra" field of the query (see trySend).
+	inflight map[uint64]string
+}
+
+// reservedAccountNames are the names accounts can't have, because they are
+// taken by files in the file system root, or in "$HOME/lib/telegramfs".
+var reservedAccountNames = map[string]bool{
+	"status":       true,
+	"config":       true,
+	"tdlib":        true,
+	"history.bolt": true,
+}
+
+// checkAccountNames returns an error unless all accounts have distinct names
+// which can be used as directory names, both in the file system served and in
+// "$HOME/lib/telegramfs".
+func checkAccountNames(accounts []tgAccountConfig) error {
+	seen := make(map[string]bool)
+	for _, c := range accounts {
+		switch {
+		case c.Name == "":
+			return errors.New("account without a name")
+		case c.Name == "." || c.Name == ".." || strings.Contains(c.Name, "/"):
+			return fmt.Errorf("invalid account name %q", c.Name)
+		case reservedAccountNames[c.Name]:
+			return fmt.Errorf("reserved account name %q", c.Name)
+		case seen[c.Name]:
+			return fmt.Errorf("duplicate account name %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// accountConfigs returns the accounts in the configuration. If it has no
+// "accounts", there's a single account, without a name, which is served at the
+// root. It exits if the accounts are not named properly (see
+// checkAccountNames).
+func accountConfigs(config *tgConfig) []tgAccountConfig {
+	if len(config.Accounts) == 0 {
+		return []tgAccountConfig{{
+			Phone:    config.Phone,
+			Key:      config.Key,
+			APIId:    config.APIId,
+			APIHash:  config.APIHash,
+			BotToken: config.BotToken,
+		}}
+	}
+	if err := checkAccountNames(config.Accounts); err != nil {
+		log.Fatalf("Could not configure accounts: %v", err)
+	}
+	accounts := make([]tgAccountConfig, len(config.Accounts))
+	for i, c := range config.Accounts {
+		if c.APIId == 0 {
+			c.APIId = config.APIId
+		}
+		if c.APIHash == "" {
+			c.APIHash = config.APIHash
+		}
+		accounts[i] = c
+	}
+	return accounts
+}
+
+// newAccount creates the tdlib client of an account and opens its Bolt
+// database. Its data is in a subdirectory of dir named after the account, or
+// directly in dir if the account has no name.
+func newAccount(conf tgAccountConfig, dir string) *account {
+	a := &account{
+		name:           conf.Name,
+		conf:           conf,
+		dataDir:        filepath.Join(dir, conf.Name),
+		msgNodes:       make(map[int64]*messageOps),
+		seconds:        make(messageSeconds),
+		chatMessages:   make(map[int64]*chatMessageIDs),
+		chatDirs:       make(map[int64]*srv.File),
+		topicDirs:      make(map[topicKey]*srv.File),
+		layouts:        make(map[*srv.File]*dateLayout),
+		readStates:     make(map[int64]*readState),
+		rootUnread:     nodes.NewTextFile(nil),
+		events:         newOutStream(),
+		callbacks:      newOutStream(),
+		pinnedIDs:      make(map[int64]map[int64]bool),
+		secretStates:   make(map[int64]*nodes.TextFile),
+		scheduledFiles: make(map[int64]*srv.File),
+		userDirs:       make(map[int64]*srv.File),
+		inflight:       make(map[uint64]string),
+		authState:      nodes.NewTextFile(nil),
+		authQR:         nodes.NewTextFile(nil),
+		authorization:  "starting",
+		connection:     "starting",
+		statusFile:     nodes.NewTextFile([]byte("starting\n")),
+	}
+	if err := os.MkdirAll(a.dataDir, 0700); err != nil {
+		log.Fatalf("Could not create directory %q: %v", a.dataDir, err)
+	}
+	a.client = newClient()
+	a.database = mustSetupDatabase(filepath.Join(a.dataDir, "history.bolt"))
+	return a
+}
+
+func newClient() unsafe.Pointer {
+	client := tgClient()
+	tgExecute(client, genericMap{
+		"@type":               "setLogVerbosityLevel",
+		"new_verbosity_level": 2,
+	})
+	return client
+}
+
+// send sends a query to the tdlib client of the account.
+func (a *account) send(query genericMap) {
+	a.clientMu.RLock()
+	defer a.clientMu.RUnlock()
+	tgSend(a.client, query)
+}
+
+// recreateClient replaces the tdlib client, once closed, with a new one, which
+// starts logging in again (see handleUpdateAuthorizationState). This happens,
+// e.g., when the session is terminated from another device. If the client was
+// closed after logging out, its database is gone, so the outbox entries
+// accepted by the old client are given to the new one when ready. Otherwise,
+// the old client may have sent them already, and the new one still knows
+// about them.
+func (a *account) recreateClient(loggedOut bool) {
+	a.clientMu.Lock()
+	tgDestroy(a.client)
+	a.client = newClient()
+	a.clientMu.Unlock()
+	a.outboxMu.Lock()
+	a.clearInflight()
+	a.outboxMu.Unlock()
+	a.removeCallbacks()
+	if loggedOut {
+		a.resetOutbox()
+	}
+}
+
+// addRoot creates the root directory of the account, within parent, or as the
+// file system root if parent is nil, and fills it with the history in the
+// database.
+func (a *account) addRoot(parent *srv.File) {
+	name := a.name
+	if parent == nil {
+		name = "root"
+	}
+	a.root = newFile()
+	if err := a.root.Add(parent, name, user, group, p.DMDIR|0777, rootOps{a: a}); err != nil {
+		log.Fatalf("Could not add directory for account %q: %v", name, err)
+	}
+	_ = newFile().Add(a.root, "status", user, group, 0444, a.statusFile)
+	_ = newFile().Add(a.root, "unread", user, group, 0444, a.rootUnread)
+	a.addAuth()
+	a.addSearch()
+	a.addUsers()
+	_ = newFile().Add(a.root, "events", user, group, 0444, newEventsOps(a.events))
+	if a.conf.BotToken != "" {
+		a.addBot()
+	}
+
+	a.addHistory()
+	a.refreshAllPending()
+}
+
+// run handles incoming events from Telegram. It won't return until the
+// program is killed or the main goroutine exits.
+func (a *account) run() {
+	m := make(map[string]int)
+	lastLogged := time.Now()
+	for {
+		event := tgReceive(a.client)
+		if event == "" {
+			continue
+		}
+
+		eventJSON, err := NewDocument(event)
+		if err != nil {
+			log.Printf("Could not make JSON document: %v", err)
+			continue
+		}
+
+		eventType, ok := eventJSON.GetString("@type")
+		if !ok {
+			log.Printf(`Could not extract string "@type"`)
+			continue
+		}
+
+		if handleResponse(eventJSON) {
+			continue
+		}
+
+		switch eventType {
+		case "updateUser":
+			a.handleUpdateUser(eventJSON)
+		case "updateNewMessage":
+			a.handleUpdateNewMessage(eventJSON)
+		case "updateMessageContent":
+			a.handleUpdateMessageContent(eventJSON)
+		case "updateForumTopicInfo":
+			a.handleUpdateForumTopicInfo(eventJSON)
+		case "updateNewChat":
+			a.handleUpdateNewChat(eventJSON)
+		case "updateChatReadInbox":
+			a.handleUpdateChatReadInbox(eventJSON)
+		case "updateChatReadOutbox":
+			a.handleUpdateChatReadOutbox(eventJSON)
+		case "updateDeleteMessages":
+			a.handleUpdateDeleteMessages(eventJSON)
+		case "updateAuthorizationState":
+			a.handleUpdateAuthorizationState(eventJSON)
+		case "updateConnectionState":
+			a.handleUpdateConnectionState(eventJSON)
+		case "updateMessageSendSucceeded":
+			a.handleUpdateMessageSendSucceeded(eventJSON)
+		case "updateMessageSendFailed":
+			a.handleUpdateMessageSendFailed(eventJSON)
+		case "updateChatHasScheduledMessages":
+			a.handleUpdateChatHasScheduledMessages(eventJSON)
+		case "updateChatDraftMessage":
+			a.handleUpdateChatDraftMessage(eventJSON)
+		case "updateChatAction", "updateUserChatAction":
+			a.handleUpdateChatAction(eventJSON)
+		case "updateUserStatus":
+			a.handleUpdateUserStatus(eventJSON)
+		case "updateUserFullInfo":
+			a.handleUpdateUserFullInfo(eventJSON)
+		case "updateMessageIsPinned":
+			a.handleUpdateMessageIsPinned(eventJSON)
+		case "updateChatPinnedMessage":
+			a.handleUpdateChatPinnedMessage(eventJSON)
+		case "updateSecretChat", "updateNewSecretChat":
+			a.handleUpdateSecretChat(eventJSON)
+		case "updateNewCallbackQuery":
+			a.handleUpdateNewCallbackQuery(eventJSON)
+		default:
+			m[eventType]++
+			if time.Since(lastLogged) > 5*time.Minute {
+				if len(m) > 0 {
+					var b bytes.Buffer
+					for e, c := range m {
+						fmt.Fprintf(&b, ", %s=%d", e, c)
+						delete(m, e)
+					}
+					log.Printf("Unhandled event types: %s", b.Bytes()[2:])
+				}
+				lastLogged = time.Now()
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestCheckAccountNames(t *testing.T) {
+	for _, c := range []struct {
+		names []string
+		ok    bool
+	}{
+		{[]string{"work", "home"}, true},
+		{[]string{"work", ""}, false},
+		{[]string{"work", "work"}, false},
+		{[]string{"a/b"}, false},
+		{[]string{"."}, false},
+		{[]string{".."}, false},
+		{[]string{"status"}, false},
+		{[]string{"tdlib"}, false},
+	} {
+		var accounts []tgAccountConfig
+		for _, name := range c.names {
+			accounts = append(accounts, tgAccountConfig{Name: name})
+		}
+		if err := checkAccountNames(accounts); (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.names, err)
+		}
+	}
+}
+
+func TestAccountConfigs(t *testing.T) {
+	config := &tgConfig{
+		Phone:   "+1",
+		APIId:   1,
+		APIHash: "hash",
+	}
+	accounts := accountConfigs(config)
+	if len(accounts) != 1 || accounts[0].Name != "" || accounts[0].Phone != "+1" {
+		t.Errorf("got %+v, want a single account without a name", accounts)
+	}
+
+	config.Accounts = []tgAccountConfig{
+		{Name: "work", Phone: "+2"},
+		{Name: "bot", BotToken: "token", APIId: 2, APIHash: "other"},
+	}
+	accounts = accountConfigs(config)
+	if len(accounts) != 2 {
+		t.Fatalf("got %d accounts, want 2", len(accounts))
+	}
+	if got := accounts[0]; got.APIId != 1 || got.APIHash != "hash" {
+		t.Errorf("got %+v, want the default API id and hash", got)
+	}
+	if got := accounts[1]; got.APIId != 2 || got.APIHash != "other" {
+		t.Errorf("got %+v, want its own API id and hash", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// typingInterval is how often we tell Telegram we are typing while composing
+// a message. Telegram stops showing chat actions after about 5 seconds.
+const typingInterval = 4 * time.Second
+
+// newActionOps returns the file system node for the "action" file of a chat,
+// which is a stream of the chat actions of the peers, one per line, as the
+// sender and the action (e.g., "typing", "recording-voice-note", or "cancel"
+// when the action is over) separated by a tab. New readers get the last
+// action first.
+func newActionOps(actions *nodes.Stream) *nodes.StreamFile {
+	ops := nodes.NewStreamFile(actions, func() nodes.Replay {
+		return nodes.Replay{Last: 1}
+	})
+	ops.Timeout = outTimeout()
+	return ops
+}
+
+// actionName converts a tdlib chat action type to the name used in "action"
+// files, e.g., "chatActionRecordingVoiceNote" to "recording-voice-note".
+func actionName(kind string) string {
+	return kebabName(strings.TrimPrefix(kind, "chatAction"))
+}
+
+// kebabName converts a camel-case name to lower case, with dashes between
+// words, e.g., "RecordingVoiceNote" to "recording-voice-note".
+func kebabName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// handleUpdateChatAction handles both updateChatAction and its older version,
+// updateUserChatAction, which only has a user id for the sender.
+func (a *account) handleUpdateChatAction(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	kind, _ := doc.GetString("action.@type")
+	c := a.findChat(chatID)
+	if c == nil {
+		return
+	}
+	var sender string
+	if userID, ok := doc.GetInt64("user_id"); ok {
+		sender = a.userHandle(userID)
+	} else if userID, ok := doc.GetInt64("sender_id.user_id"); ok {
+		sender = a.userHandle(userID)
+	} else if senderChatID, ok := doc.GetInt64("sender_id.chat_id"); ok {
+		sender = fmt.Sprintf("%d", senderChatID)
+		if sc := a.findChat(senderChatID); sc != nil {
+			sender = sc.Name
+		}
+	}
+	c.Ops.(*chatOps).actions.Append(nodes.Record{
+		Data: []byte(sender + "\t" + actionName(kind) + "\n"),
+	})
+}
+
+// FidDestroy implements srv.FDestroyOp. It forgets what was written through a
+// fid that was not closed, e.g., because its connection was lost, and stops
+// telling Telegram we are typing if it was the last writer.
+func (c *inOps) FidDestroy(fid *srv.FFid) {
+	c.mu.Lock()
+	c.stopComposing(fid)
+	c.mu.Unlock()
+}
+
+// stopComposing forgets what was written through a fid, and stops telling
+// Telegram we are typing if it was the last writer. The caller must hold c.mu.
+func (c *inOps) stopComposing(fid *srv.FFid) {
+	delete(c.written, fid)
+	if len(c.written) == 0 && c.composing != nil {
+		close(c.composing)
+		c.composing = nil
+	}
+}
+
+// compose tells Telegram that we are typing in the chat (or topic) of an "in"
+// file, until done is closed. Nothing is sent while all messages being
+// written are scheduled.
+func (c *inOps) compose(done chan struct{}) {
+	t := time.NewTicker(typingInterval)
+	defer t.Stop()
+	for {
+		c.mu.Lock()
+		scheduled := !c.sendAt.IsZero()
+		if !scheduled {
+			scheduled = true
+			for _, b := range c.written {
+				if !bytes.HasPrefix(b.Bytes(), []byte("@at ")) {
+					scheduled = false
+				}
+			}
+		}
+		c.mu.Unlock()
+		if !scheduled {
+			query := genericMap{
+				"@type":   "sendChatAction",
+				"chat_id": c.chatID,
+				"action": genericMap{
+					"@type": "chatActionTyping",
+				},
+			}
+			if c.threadID != 0 {
+				query["message_thread_id"] = c.threadID
+			}
+			c.a.send(query)
+		}
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+	}
+}
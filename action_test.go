@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestKebabName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"Typing", "typing"},
+		{"RecordingVoiceNote", "recording-voice-note"},
+		{"WaitingForNetwork", "waiting-for-network"},
+		{"ready", "ready"},
+	} {
+		if got := kebabName(c.name); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStopComposing(t *testing.T) {
+	c := newInOps(nil, 1, 0)
+	first, second := &srv.FFid{}, &srv.FFid{}
+	done := make(chan struct{})
+	c.written[first] = new(bytes.Buffer)
+	c.written[second] = new(bytes.Buffer)
+	c.composing = done
+	c.stopComposing(first)
+	select {
+	case <-done:
+		t.Fatal("stopped composing while another writer is composing")
+	default:
+	}
+	c.stopComposing(second)
+	select {
+	case <-done:
+	default:
+		t.Fatal("still composing after the last writer went away")
+	}
+}
+
+func TestInFidDestroy(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	a.authorized = true
+	c := newInOps(a, 1, 0)
+	// Scheduled, so that we don't tell Telegram we are typing.
+	c.sendAt = time.Now().Add(time.Hour)
+	lost, kept := &srv.FFid{}, &srv.FFid{}
+	for fid, data := range map[*srv.FFid]string{lost: "half a mess", kept: "hello"} {
+		if _, err := c.Write(fid, []byte(data), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.FidDestroy(lost)
+	c.mu.Lock()
+	if got := c.written[kept].String(); got != "hello" || len(c.written) != 1 {
+		t.Errorf("got %q written by the remaining fid, and %d fids, want %q and 1", got, len(c.written), "hello")
+	}
+	if c.composing == nil {
+		t.Error("stopped composing while another writer is composing")
+	}
+	c.mu.Unlock()
+	c.FidDestroy(kept)
+	if c.composing != nil {
+		t.Error("still composing after the last writer went away")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// membersLimit is the number of supergroup members fetched per query.
+const membersLimit = 200
+
+// membersOps is the file system node for the "members" directory of a chat.
+// It has a file per member of a group, named after the member, and containing
+// the member's role (e.g., "creator", "administrator", "member", or
+// "restricted"). The members are fetched whenever the directory is opened.
+type membersOps struct {
+	dirOps
+	a      *account
+	chatID int64
+
+	mu    sync.Mutex
+	files []*srv.File
+}
+
+// chatMember is a member of a group, as reported by Telegram.
+type chatMember struct {
+	userID int64
+	role   string
+}
+
+// Open implements srv.FOpenOp.
+func (m *membersOps) Open(fid *srv.FFid, _ uint8) error {
+	members, err := m.a.getMembers(m.chatID)
+	if err != nil {
+		// Serve what we know.
+		log.Printf("Could not get members of chat %d: %v", m.chatID, err)
+		return nil
+	}
+	handles := make(map[int64]string)
+	_ = m.a.database.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		for _, member := range members {
+			if h := getHandle(users, member.userID); h != nil {
+				handles[member.userID] = string(h)
+			}
+		}
+		return nil
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		f.Remove()
+	}
+	m.files = nil
+	for _, member := range members {
+		name, ok := handles[member.userID]
+		if !ok {
+			name = fmt.Sprintf("%d", member.userID)
+		}
+		if fid.F.Find(name) != nil {
+			name = fmt.Sprintf("%s-%d", name, member.userID)
+		}
+		f := newFile()
+		if err := f.Add(fid.F, name, user, group, 0444, nodes.NewTextFile([]byte(member.role+"\n"))); err != nil {
+			continue
+		}
+		m.files = append(m.files, f)
+	}
+	return nil
+}
+
+// getMembers fetches the members of a basic group or supergroup. Other chats
+// have no members.
+func (a *account) getMembers(chatID int64) ([]chatMember, error) {
+	chat, err := a.query(genericMap{
+		"@type":   "getChat",
+		"chat_id": chatID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	kind, _ := chat.GetString("type.@type")
+	switch kind {
+	case "chatTypeBasicGroup":
+		groupID, _ := chat.GetInt64("type.basic_group_id")
+		info, err := a.query(genericMap{
+			"@type":          "getBasicGroupFullInfo",
+			"basic_group_id": groupID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return parseMembers(info), nil
+	case "chatTypeSupergroup":
+		groupID, _ := chat.GetInt64("type.supergroup_id")
+		var members []chatMember
+		for {
+			page, err := a.query(genericMap{
+				"@type":         "getSupergroupMembers",
+				"supergroup_id": groupID,
+				"offset":        len(members),
+				"limit":         membersLimit,
+			})
+			if err != nil {
+				return nil, err
+			}
+			more := parseMembers(page)
+			members = append(members, more...)
+			total, _ := page.GetInt64("total_count")
+			if len(more) == 0 || int64(len(members)) >= total {
+				return members, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// parseMembers returns the members in a basicGroupFullInfo or chatMembers
+// object.
+func parseMembers(doc Document) []chatMember {
+	docs, _ := doc.GetDocuments("members", "member")
+	var members []chatMember
+	for _, d := range docs {
+		userID, ok := d.GetInt64("member.user_id")
+		if !ok {
+			// Newer tdlib versions.
+			if userID, ok = d.GetInt64("member.member_id.user_id"); !ok {
+				continue
+			}
+		}
+		status, _ := d.GetString("member.status.@type")
+		members = append(members, chatMember{
+			userID: userID,
+			role:   strings.ToLower(strings.TrimPrefix(status, "chatMemberStatus")),
+		})
+	}
+	return members
+}
+
+// add adds a user to the group, e.g., "add alice".
+func (c *ctlOps) add(args string) error {
+	userID, err := c.a.resolveUser(args)
+	if err != nil {
+		return err
+	}
+	_, err = c.a.query(genericMap{
+		"@type":         "addChatMember",
+		"chat_id":       c.chatID,
+		"user_id":       userID,
+		"forward_limit": 0,
+	})
+	return err
+}
+
+// kick removes a user from the group, without banning them.
+func (c *ctlOps) kick(args string) error {
+	userID, err := c.a.resolveUser(args)
+	if err != nil {
+		return err
+	}
+	member := genericMap{
+		"@type":   "messageSenderUser",
+		"user_id": userID,
+	}
+	if _, err := c.a.query(genericMap{
+		"@type":     "setChatMemberStatus",
+		"chat_id":   c.chatID,
+		"member_id": member,
+		"status": genericMap{
+			"@type": "chatMemberStatusBanned",
+		},
+	}); err != nil {
+		return err
+	}
+	// Lift the ban, which only remains in supergroups.
+	c.a.send(genericMap{
+		"@type":     "setChatMemberStatus",
+		"chat_id":   c.chatID,
+		"member_id": member,
+		"status": genericMap{
+			"@type": "chatMemberStatusLeft",
+		},
+	})
+	return nil
+}
+
+// title changes the title of the chat.
+func (c *ctlOps) title(args string) error {
+	if args == "" {
+		return errors.New("missing title")
+	}
+	_, err := c.a.query(genericMap{
+		"@type":   "setChatTitle",
+		"chat_id": c.chatID,
+		"title":   args,
+	})
+	return err
+}
+
+// pin pins a message, given the path of its file relative to the chat
+// directory.
+func (c *ctlOps) pin(args string) error {
+	return c.a.pinMessageFile(c.chatID, c.dir, args)
+}
+
+// unpin unpins a message, given like for pin, or all messages if none is
+// given.
+func (c *ctlOps) unpin(args string) error {
+	query := genericMap{
+		"@type":   "unpinAllChatMessages",
+		"chat_id": c.chatID,
+	}
+	if args != "" {
+		messageID, err := messageFileID(c.dir, args)
+		if err != nil {
+			return err
+		}
+		query["@type"] = "unpinChatMessage"
+		query["message_id"] = messageID
+	}
+	_, err := c.a.query(query)
+	return err
+}
+
+// messageFileID returns the id of the message whose file has the given path
+// relative to the chat directory.
+func messageFileID(chat *srv.File, path string) (int64, error) {
+	f := chat
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		next := f.Find(name)
+		if next == nil {
+			next = lookupAlias(f, name)
+		}
+		if next == nil {
+			return 0, fmt.Errorf("%s: file not found", path)
+		}
+		f = next
+	}
+	switch ops := f.Ops.(type) {
+	case *messageOps:
+		return ops.messageID, nil
+	case messageCopyOps:
+		return ops.messageID, nil
+	}
+	return 0, fmt.Errorf("%s: not a message file", path)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+type aliasKey struct {
+	dir  *srv.File
+	name string
+}
+
+// aliases are alternative names for files, which can be walked to but are not
+// listed in directories.
+var (
+	aliasesMu sync.Mutex
+	aliases   = make(map[aliasKey]*srv.File)
+)
+
+// addAlias makes f reachable as name within dir, unless name is taken.
+func addAlias(dir *srv.File, name string, f *srv.File) {
+	key := aliasKey{dir: dir, name: name}
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	if aliases[key] == nil {
+		aliases[key] = f
+	}
+}
+
+// removeAliases removes the aliases of f.
+func removeAliases(f *srv.File) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	for key, g := range aliases {
+		if g == f {
+			delete(aliases, key)
+		}
+	}
+}
+
+// lookupAlias is used by lookup.
+func lookupAlias(dir *srv.File, name string) *srv.File {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	return aliases[aliasKey{dir: dir, name: name}]
+}
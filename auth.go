@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the width of the blank border around QR codes, in modules.
+const qrQuietZone = 4
+
+// addAuth adds the "auth" directory to the root directory of the account. It
+// contains "state", with the authorization state (see
+// handleUpdateAuthorizationState), "qr", with the QR code to scan when
+// logging in with another device, and files to write what Telegram asks for
+// to log in: "code", "password", and "register" (see authOps).
+func (a *account) addAuth() {
+	dir := newFile()
+	_ = dir.Add(a.root, "auth", user, group, p.DMDIR|0555, dirOps{})
+	_ = newFile().Add(dir, "state", user, group, 0444, a.authState)
+	_ = newFile().Add(dir, "qr", user, group, 0444, a.authQR)
+	_ = newFile().Add(dir, "code", user, group, 0222, &authOps{a: a, submit: (*account).checkCode})
+	_ = newFile().Add(dir, "password", user, group, 0222, &authOps{a: a, submit: (*account).checkPassword})
+	_ = newFile().Add(dir, "register", user, group, 0222, &authOps{a: a, submit: (*account).register})
+}
+
+// authOps is the file system node for the files of the "auth" directory that
+// submit what is written to them, e.g., "echo 12345 > auth/code". Each write
+// must contain the whole text, and fails if Telegram rejects it.
+type authOps struct {
+	a      *account
+	submit func(a *account, text string) error
+}
+
+// Wstat implements srv.FWstatOp, to allow opening with truncation.
+func (o *authOps) Wstat(*srv.FFid, *p.Dir) error {
+	return nil
+}
+
+// Write implements srv.FWriteOp.
+func (o *authOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return 0, errors.New("nothing to submit")
+	}
+	if err := o.submit(o.a, text); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (a *account) checkCode(code string) error {
+	_, err := a.query(genericMap{
+		"@type": "checkAuthenticationCode",
+		"code":  code,
+	})
+	return err
+}
+
+func (a *account) checkPassword(password string) error {
+	_, err := a.query(genericMap{
+		"@type":    "checkAuthenticationPassword",
+		"password": password,
+	})
+	return err
+}
+
+// register registers a new Telegram user, given the first name and,
+// optionally, the last name separated by a space.
+func (a *account) register(name string) error {
+	names := strings.SplitN(name, " ", 2)
+	if len(names) == 1 {
+		names = append(names, "")
+	}
+	_, err := a.query(genericMap{
+		"@type":      "registerUser",
+		"first_name": names[0],
+		"last_name":  strings.TrimSpace(names[1]),
+	})
+	return err
+}
+
+// handleUpdateAuthorizationState answers what tdlib asks for to log in, as far
+// as the configuration allows, and updates "auth/state". Its first line is the
+// state, e.g., "wait-code" or "ready", and further lines have details, such as
+// the hint for the password. Once tdlib closes the client, e.g., after logging
+// out, it starts over with a new client (see recreateClient).
+func (a *account) handleUpdateAuthorizationState(j Document) {
+	kind, ok := j.GetString("authorization_state.@type")
+	if !ok {
+		log.Println("no auth state type")
+		return
+	}
+	name := kebabName(strings.TrimPrefix(kind, "authorizationState"))
+	a.setReadiness(func() {
+		a.authorized = kind == "authorizationStateReady"
+		a.authorization = name
+	})
+	var state, qrCode bytes.Buffer
+	fmt.Fprintf(&state, "%s\n", name)
+	switch kind {
+	case "authorizationStateWaitCode":
+		phone, _ := j.GetString("authorization_state.code_info.phone_number")
+		via, _ := j.GetString("authorization_state.code_info.type.@type")
+		fmt.Fprintf(&state, "phone %s\nvia %s\n", phone, kebabName(strings.TrimPrefix(via, "authenticationCodeType")))
+		if authorizationCode == "" {
+			log.Printf("Telegram requires an authorization code, which should have been sent now; write it to %s", a.authPath("code"))
+			break
+		}
+		a.send(genericMap{
+			"@type": "checkAuthenticationCode",
+			"code":  authorizationCode,
+		})
+	case "authorizationStateWaitPassword":
+		if hint, _ := j.GetString("authorization_state.password_hint"); hint != "" {
+			fmt.Fprintf(&state, "hint %s\n", hint)
+		}
+		log.Printf("Telegram requires the two-step verification password; write it to %s", a.authPath("password"))
+	case "authorizationStateWaitRegistration":
+		log.Printf("Telegram requires registering a new user; write the first and last name to %s", a.authPath("register"))
+	case "authorizationStateWaitPhoneNumber":
+		if a.conf.BotToken != "" {
+			a.send(genericMap{
+				"@type": "checkAuthenticationBotToken",
+				"token": a.conf.BotToken,
+			})
+			break
+		}
+		if a.conf.Phone == "" {
+			a.requestQRCode()
+			break
+		}
+		a.send(genericMap{
+			"@type":        "setAuthenticationPhoneNumber",
+			"phone_number": a.conf.Phone,
+		})
+	case "authorizationStateWaitOtherDeviceConfirmation":
+		link, _ := j.GetString("authorization_state.link")
+		fmt.Fprintf(&state, "link %s\n", link)
+		code, err := qrText(link)
+		if err != nil {
+			log.Printf("Could not encode QR code: %v", err)
+			break
+		}
+		fmt.Fprintf(&qrCode, "%s\n", link)
+		qrCode.Write(code)
+		fmt.Fprintf(os.Stderr, "Scan this QR code with Telegram on a logged in device (Settings, Devices, Link Desktop Device), or read it from %s:\n%s", a.authPath("qr"), code)
+	case "authorizationStateWaitEncryptionKey":
+		a.send(genericMap{
+			"@type": "checkDatabaseEncryptionKey",
+			"key":   a.conf.Key,
+		})
+	case "authorizationStateReady":
+	case "authorizationStateLoggingOut":
+		log.Printf("Logging out of Telegram account %q", a.name)
+		a.loggingOut = true
+	case "authorizationStateClosing":
+	case "authorizationStateClosed":
+		// No more updates will come from this client. Start over with a new
+		// one, e.g., if logged out by terminating the session from another
+		// device.
+		log.Printf("Telegram client of account %q closed, logging in again", a.name)
+		loggedOut := a.loggingOut
+		a.loggingOut = false
+		a.recreateClient(loggedOut)
+	case "authorizationStateWaitTdlibParameters":
+		a.send(genericMap{
+			"@type": "setTdlibParameters",
+			"parameters": genericMap{
+				"database_directory":       filepath.Join(a.dataDir, "tdlib"),
+				"use_message_database":     true,
+				"use_secret_chats":         true,
+				"api_id":                   a.conf.APIId,
+				"api_hash":                 a.conf.APIHash,
+				"system_language_code":     "en",
+				"device_model":             "Desktop",
+				"system_version":           "Unknown",
+				"application_version":      "1.0",
+				"enable_storage_optimizer": true,
+			},
+		})
+	default:
+		log.Printf("Unhandled authorization state message type: %v", kind)
+	}
+	a.authState.Set(state.Bytes())
+	a.authQR.Set(qrCode.Bytes())
+}
+
+// requestQRCode asks to log in by confirming from another device, which is
+// done by scanning a QR code (see qrText).
+func (a *account) requestQRCode() {
+	a.sendCallback(genericMap{
+		"@type":          "requestQrCodeAuthentication",
+		"other_user_ids": []int64{},
+	}, func(doc Document) {
+		if err := responseError(doc); err != nil {
+			log.Printf("Could not request QR code authentication: %v", err)
+		}
+	})
+}
+
+// qrText renders text as a QR code with Unicode block characters, two rows of
+// modules per line, for terminals with light text on a dark background.
+func qrText(text string) ([]byte, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return nil, err
+	}
+	light := func(x, y int) bool {
+		if y >= code.Size+qrQuietZone {
+			return false
+		}
+		return !code.Black(x, y)
+	}
+	var b bytes.Buffer
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			switch top, bottom := light(x, y), light(x, y+1); {
+			case top && bottom:
+				b.WriteString("\u2588")
+			case top:
+				b.WriteString("\u2580")
+			case bottom:
+				b.WriteString("\u2584")
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// authPath returns the path of a file in the "auth" directory of the account,
+// for messages telling what to write to it.
+func (a *account) authPath(name string) string {
+	return filepath.Join("/", a.name, "auth", name)
+}
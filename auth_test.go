@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"rsc.io/qr"
+)
+
+func TestQRText(t *testing.T) {
+	const link = "tg://login?token=abc"
+	text, err := qrText(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := qr.Encode(link, qr.L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := code.Size + 2*qrQuietZone
+	lines := strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+	if got, want := len(lines), (width+1)/2; got != want {
+		t.Errorf("got %d lines, want %d", got, want)
+	}
+	for i, line := range lines {
+		if got := utf8.RuneCountInString(line); got != width {
+			t.Errorf("line %d: got %d columns, want %d", i, got, width)
+		}
+	}
+	// The quiet zone is light, i.e., drawn with full blocks.
+	if want := strings.Repeat("█", width); lines[0] != want {
+		t.Errorf("got first line %q, want %q", lines[0], want)
+	}
+}
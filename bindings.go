@@ -36,6 +36,10 @@ func tgSend(client unsafe.Pointer, query genericMap) {
 	C.td_json_client_send(client, s)
 }
 
+func tgDestroy(client unsafe.Pointer) {
+	C.td_json_client_destroy(client)
+}
+
 func tgReceive(client unsafe.Pointer) string {
 	return C.GoString(C.td_json_client_receive(client, 1.0))
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// addBot adds the "bot" directory to the root directory of a bot account. It
+// contains "events", a stream of the callback queries from inline keyboard
+// buttons (see handleUpdateNewCallbackQuery), "answer", to answer them (see
+// answerOps), and "commands", with the bot's commands (see commandsOps).
+func (a *account) addBot() {
+	dir := newFile()
+	_ = dir.Add(a.root, "bot", user, group, p.DMDIR|0555, dirOps{})
+	_ = newFile().Add(dir, "events", user, group, 0444, newEventsOps(a.callbacks))
+	_ = newFile().Add(dir, "answer", user, group, 0222, &answerOps{a: a})
+	commands := &commandsOps{
+		TextFile: nodes.NewTextFile(nil),
+		a:        a,
+		written:  make(map[*srv.FFid]*bytes.Buffer),
+	}
+	_ = newFile().Add(dir, "commands", user, group, 0666, commands)
+}
+
+// handleUpdateNewCallbackQuery adds a line to the "bot/events" stream for a
+// callback query, i.e., a press of an inline keyboard button. The line has
+// tab-separated fields: the query id (to answer it, see answerOps), the chat
+// handle, the path of the file of the message with the button (relative to the
+// chat directory), the sender, and the data of the button.
+func (a *account) handleUpdateNewCallbackQuery(doc Document) {
+	queryID, ok := doc.GetString("id")
+	if !ok {
+		// Older tdlib versions give 64-bit integers as numbers.
+		id, _ := doc.GetInt64("id")
+		queryID = fmt.Sprintf("%d", id)
+	}
+	chatID, _ := doc.GetInt64("chat_id")
+	messageID, _ := doc.GetInt64("message_id")
+	senderID, _ := doc.GetInt64("sender_user_id")
+	handle := fmt.Sprintf("%d", chatID)
+	chat := a.findChat(chatID)
+	if chat != nil {
+		handle = chat.Name
+	}
+	var name string
+	if m := a.findMessage(messageID); m != nil {
+		name = relativePath(m.file, chat)
+	}
+	var data string
+	switch kind, _ := doc.GetString("payload.@type"); kind {
+	case "callbackQueryPayloadData", "callbackQueryPayloadDataWithPassword":
+		encoded, _ := doc.GetString("payload.data")
+		if b, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			data = string(b)
+		} else {
+			data = encoded
+		}
+	case "callbackQueryPayloadGame":
+		data, _ = doc.GetString("payload.game_short_name")
+	}
+	data = strings.Replace(strings.Replace(data, "\n", " ", -1), "\t", " ", -1)
+	a.callbacks.Append(nodes.Record{
+		Data: []byte(strings.Join([]string{queryID, handle, name, a.userHandle(senderID), data}, "\t") + "\n"),
+	})
+}
+
+// answerOps is the file system node for "bot/answer". Writing a line with the
+// id of a callback query, optionally followed by a text, answers the query,
+// e.g., "echo 123 Done > bot/answer". The text is shown to the user who
+// pressed the button.
+type answerOps struct {
+	a *account
+}
+
+// Wstat implements srv.FWstatOp, to allow opening with truncation.
+func (o *answerOps) Wstat(*srv.FFid, *p.Dir) error {
+	return nil
+}
+
+// Write implements srv.FWriteOp. Each write must contain whole lines.
+func (o *answerOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if fields[0] == "" {
+			continue
+		}
+		if len(fields) == 1 {
+			fields = append(fields, "")
+		}
+		_, err := o.a.query(genericMap{
+			"@type":             "answerCallbackQuery",
+			"callback_query_id": fields[0],
+			"text":              strings.TrimSpace(fields[1]),
+			"show_alert":        false,
+			"url":               "",
+			"cache_time":        0,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// commandsOps is the file system node for "bot/commands", which lists the
+// bot's commands, one per line, as the command and its description separated
+// by a space, e.g., "start Start talking to the bot". The commands are fetched
+// whenever the file is opened. Writing to it replaces the commands with the
+// ones written, when the file is closed.
+type commandsOps struct {
+	*nodes.TextFile
+	a *account
+
+	// What was written through each fid, which is present if it wrote or
+	// truncated the file.
+	mu      sync.Mutex
+	written map[*srv.FFid]*bytes.Buffer
+}
+
+// buffer returns what was written through the fid, creating it if needed. The
+// caller must hold c.mu.
+func (c *commandsOps) buffer(fid *srv.FFid) *bytes.Buffer {
+	b := c.written[fid]
+	if b == nil {
+		b = new(bytes.Buffer)
+		c.written[fid] = b
+	}
+	return b
+}
+
+// Open implements srv.FOpenOp.
+func (c *commandsOps) Open(*srv.FFid, uint8) error {
+	doc, err := c.a.query(genericMap{
+		"@type": "getCommands",
+	})
+	if err != nil {
+		// Serve what we know.
+		log.Printf("Could not get bot commands: %v", err)
+		return nil
+	}
+	commands, _ := doc.GetDocuments("commands", "command")
+	var b bytes.Buffer
+	for _, command := range commands {
+		name, _ := command.GetString("command.command")
+		description, _ := command.GetString("command.description")
+		fmt.Fprintf(&b, "%s %s\n", name, description)
+	}
+	c.Set(b.Bytes())
+	return nil
+}
+
+// Wstat implements srv.FWstatOp. Truncating the file, as in "echo start Start
+// > bot/commands", replaces the commands rather than adding to them.
+func (c *commandsOps) Wstat(fid *srv.FFid, dir *p.Dir) error {
+	if dir.ChangeLength() && dir.Length == 0 {
+		c.mu.Lock()
+		c.buffer(fid)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Write implements srv.FWriteOp. It appends the data to the commands to set
+// when the fid is closed. The offset is ignored.
+func (c *commandsOps) Write(fid *srv.FFid, data []byte, _ uint64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buffer(fid).Write(data)
+}
+
+// FidDestroy implements srv.FDestroyOp. It forgets what was written through a
+// fid that was not closed, e.g., because its connection was lost.
+func (c *commandsOps) FidDestroy(fid *srv.FFid) {
+	c.mu.Lock()
+	delete(c.written, fid)
+	c.mu.Unlock()
+}
+
+// Clunk implements srv.FClunkOp. It sets the commands written through the fid,
+// if it wrote or truncated the file.
+func (c *commandsOps) Clunk(fid *srv.FFid) error {
+	c.mu.Lock()
+	written := c.written[fid]
+	delete(c.written, fid)
+	c.mu.Unlock()
+	if written == nil {
+		return nil
+	}
+	text := written.String()
+	commands := []genericMap{}
+	var b bytes.Buffer
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if fields[0] == "" {
+			continue
+		}
+		if len(fields) == 1 || strings.TrimSpace(fields[1]) == "" {
+			return fmt.Errorf("missing description for command %q", fields[0])
+		}
+		name := strings.TrimPrefix(fields[0], "/")
+		description := strings.TrimSpace(fields[1])
+		commands = append(commands, genericMap{
+			"@type":       "botCommand",
+			"command":     name,
+			"description": description,
+		})
+		fmt.Fprintf(&b, "%s %s\n", name, description)
+	}
+	_, err := c.a.query(genericMap{
+		"@type":    "setCommands",
+		"commands": commands,
+	})
+	if err != nil {
+		return fmt.Errorf("could not set commands: %v", err)
+	}
+	c.Set(b.Bytes())
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+func TestCommandsReaderClunk(t *testing.T) {
+	// Without an account, setting the commands would panic.
+	c := &commandsOps{
+		TextFile: nodes.NewTextFile(nil),
+		written:  make(map[*srv.FFid]*bytes.Buffer),
+	}
+	writer, reader := &srv.FFid{}, &srv.FFid{}
+	if _, err := c.Write(writer, []byte("start Start\nhel"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clunk(reader); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.written[writer].String(); got != "start Start\nhel" {
+		t.Errorf("got %q written by the writer, want it kept", got)
+	}
+	c.FidDestroy(writer)
+	if len(c.written) != 0 {
+		t.Errorf("got %d buffers, want none after the writer went away", len(c.written))
+	}
+}
@@ -2,8 +2,66 @@ package main
 
 type tgConfig struct {
 	ListenAddr string `json:"listen_addr"` // The file server will listen on this TCP address.
-	Phone      string `json:"phone"`       // Your phone number.
+	Phone      string `json:"phone"`       // Your phone number, or empty to log in with a QR code.
 	Key        string `json:"key"`         // An encryption key (used by tdlib).
 	APIId      int    `json:"api_id"`
 	APIHash    string `json:"api_hash"`
+
+	// If BotToken is set, telegramfs logs in as the bot with that token
+	// (from @BotFather) rather than with Phone, and serves a "bot" directory.
+	BotToken string `json:"bot_token"`
+
+	// If Accounts is not empty, each account is served as a top-level
+	// directory named after it, and Phone, Key, and BotToken above are
+	// ignored. Accounts without API id and hash use the ones above.
+	Accounts []tgAccountConfig `json:"accounts"`
+
+	// Reading message files marks the messages read in Telegram, unless
+	// NoMarkRead is set, or the reading connection attached with one of the
+	// QuietAnames, e.g., "9p -A backup ...". This allows indexers and backup
+	// jobs to walk the tree without changing read receipts.
+	NoMarkRead  bool     `json:"no_mark_read"`
+	QuietAnames []string `json:"quiet_anames"`
+
+	// If set, messages delivered to readers of "out" files are marked read
+	// too, subject to the same rules as message files.
+	MarkReadOut bool `json:"mark_read_out"`
+
+	// The "out" files retain the last OutBuffer messages (default 1000). New
+	// readers get the messages specified by OutReplay: "all" (the default),
+	// "tail", a number of messages, or "since" followed by a time. Chats can
+	// override this via their "ctl" files.
+	OutBuffer int    `json:"out_buffer"`
+	OutReplay string `json:"out_replay"`
+
+	// If positive, reads of "out" files that block for OutTimeout seconds
+	// return no data (end of file), so clients can reconnect cleanly.
+	OutTimeout int `json:"out_timeout"`
+
+	// Message files are named after the message unix timestamp, e.g.,
+	// "1600000000.txt", and if other messages in the same directory have the
+	// same timestamp, all but the one with the smallest id have their id
+	// appended, e.g., "1600000000-123.txt". If MessageNames is "unix-id", the
+	// id is always appended, and the message with the smallest id of each
+	// second can also be accessed via its timestamp alone (these aliases are
+	// not listed in directories).
+	MessageNames string `json:"message_names"`
+
+	// If Layout is "date", message files are in YYYY/MM/DD subdirectories of
+	// chat directories, rather than directly in chat directories.
+	Layout string `json:"layout"`
+}
+
+// tgAccountConfig is the configuration of one of several accounts. Its tdlib
+// and Bolt databases are in a directory named after it, e.g.,
+// "$HOME/lib/telegramfs/work".
+type tgAccountConfig struct {
+	Name    string `json:"name"`  // The top-level directory, e.g., "work".
+	Phone   string `json:"phone"` // The account's phone number, or empty (see Phone in tgConfig).
+	Key     string `json:"key"`   // An encryption key (used by tdlib).
+	APIId   int    `json:"api_id"`
+	APIHash string `json:"api_hash"`
+
+	// If set, the account is a bot (see BotToken in tgConfig).
+	BotToken string `json:"bot_token"`
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// ctlOps is a file system node for controlling a chat by writing commands to
+// it, one per line. Reading it shows the current settings.
+type ctlOps struct {
+	a      *account
+	chatID int64
+	dir    *srv.File
+}
+
+// chatCommands maps the first word of a command to its implementation, which
+// gets the rest of the command line.
+var chatCommands = map[string]func(c *ctlOps, args string) error{
+	"replay":  (*ctlOps).replay,
+	"retry":   (*ctlOps).retry,
+	"discard": (*ctlOps).discard,
+	"add":     (*ctlOps).add,
+	"kick":    (*ctlOps).kick,
+	"title":   (*ctlOps).title,
+	"pin":     (*ctlOps).pin,
+	"unpin":   (*ctlOps).unpin,
+	"secret":  (*ctlOps).secret,
+	"cancel":  (*ctlOps).cancel,
+}
+
+// Wstat implements srv.FWstatOp. It allows opening with truncation, as in
+// "echo replay tail > chat/ctl".
+func (c *ctlOps) Wstat(*srv.FFid, *p.Dir) error {
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (c *ctlOps) Read(_ *srv.FFid, buf []byte, offset uint64) (int, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "replay %s\n", c.out("out").getReplay())
+	if offset >= uint64(b.Len()) {
+		return 0, nil
+	}
+	return copy(buf, b.Bytes()[offset:]), nil
+}
+
+// Write implements srv.FWriteOp. Each write must contain whole commands.
+func (c *ctlOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		args := strings.SplitN(line, " ", 2)
+		command := chatCommands[args[0]]
+		if command == nil {
+			return 0, fmt.Errorf("unknown command %q", args[0])
+		}
+		if len(args) == 1 {
+			args = append(args, "")
+		}
+		if err := command(c, strings.TrimSpace(args[1])); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Remove allows removing the control file, so that chats can be removed via
+// recursive remove.
+func (c *ctlOps) Remove(*srv.FFid) error {
+	return nil
+}
+
+func (c *ctlOps) out(name string) *outOps {
+	return c.dir.Find(name).Ops.(*outOps)
+}
+
+// replay sets the messages replayed to new readers of the chat's "out" file.
+func (c *ctlOps) replay(args string) error {
+	r, err := nodes.ParseReplay(args)
+	if err != nil {
+		return err
+	}
+	c.out("out").setReplay(r)
+	c.out("out.json").setReplay(r)
+	return nil
+}
+
+// retry queues the chat's failed messages (see the "pending" file) for
+// sending again.
+func (c *ctlOps) retry(string) error {
+	return c.a.retryFailed(c.chatID)
+}
+
+// discard removes the chat's failed messages from the outbox.
+func (c *ctlOps) discard(string) error {
+	return c.a.discardFailed(c.chatID)
+}
+
+// cancel cancels a scheduled message of the chat, given its id or the name of
+// its file in the "scheduled" directory.
+func (c *ctlOps) cancel(args string) error {
+	name := strings.TrimSuffix(args, ".txt")
+	if i := strings.LastIndexByte(name, '-'); i >= 0 {
+		name = name[i+1:]
+	}
+	id, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad scheduled message %q", args)
+	}
+	return c.a.cancelScheduled(c.chatID, id)
+}
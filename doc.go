@@ -11,25 +11,182 @@
 // Telegramfs serves a 9P file server listening at the configured address (see
 // config.go). You most likely want to use localhost!
 //
+// Several Telegram accounts can be served at once by listing them under
+// "accounts" in the configuration file. Each account is then served as a
+// directory of the root named after the account, e.g., "/work" and
+// "/personal", which contains everything described below for the root
+// directory. Otherwise, the single account is served at the root. Account
+// names must be distinct, must not contain slashes, and must not be one of
+// "status", "config", "tdlib", or "history.bolt".
+//
 // The file system has a directory per chat named as the contact/chat name,
 // converted to snake-case.
 //
+// Chat directories appear when messages arrive. To message someone first,
+// create a directory named after their username or handle, or their name in
+// your contacts, e.g., "mkdir /mnt/telegram/@alice". This starts a private
+// chat, whose directory is named after the user like the others, but can also
+// be reached with the name it was created with until telegramfs is restarted.
+//
 // Within each such directory, is a file per message, whose name is a unix
-// timestamp with a ".txt" extension.
+// timestamp with a ".txt" extension. If several messages have the same
+// timestamp, all but the one with the smallest id also have the message id in
+// the name, e.g., "1600000000-123.txt". The configuration file can require
+// all message file names to contain the message id (see config.go).
+//
+// Chats with many messages can have their message files organized in
+// YYYY/MM/DD subdirectories of the chat directory, by setting "layout" to
+// "date" in the configuration file. In that case, chat directories also
+// contain a "latest" directory, with copies of the last 20 message files, and
+// a "today" directory, with copies of today's message files.
 //
-// When a message file is read, the message is marked read in Telegram.
+// Next to each message file is a file with the same name but a ".json"
+// extension, containing the message in JSON format, with its id, chat id,
+// time, sender, text, quoted text, id of the message replied to, and whether
+// it is outgoing or pinned. Similarly, "out.json" is like "out" (see below)
+// but has a message per line in JSON format. These are meant for scripts, as
+// the text format can be ambiguous.
+//
+// When a message file is read, the message is marked read in Telegram. This
+// can be disabled altogether, or only for connections that attach with
+// specific names (e.g., "9p -A backup"), via the configuration file, so that
+// automated readers don't change read receipts.
+//
+// The "unread" file within each chat directory contains the number of unread
+// messages and the name of the first unread message file. If the peer has read
+// any of our messages, a second line contains "seen" and the name of the last
+// outgoing message file the peer has read. The "unread" file in the root
+// directory lists the chats with unread messages, one per line, as the chat
+// directory name and the number of unread messages separated by a tab.
 //
 // An additional file called "in" within each chat directory sends each series
 // of writes as a message (that means, the message is sent when the file is
 // closed, not as content is written to it).
 //
+// Outgoing messages are stored in the database until Telegram confirms they
+// were sent, and are sent when Telegram is connected and authorized, even
+// after a restart. The "pending" file within each chat directory lists the
+// messages not yet sent, one per line, as an id, "pending" or "failed", the
+// text, and for failed messages, the error, separated by tabs. Writing "retry"
+// to the chat's "ctl" file sends failed messages again, and writing "discard"
+// drops them.
+//
+// Messages can be scheduled by writing them to "in.at/WHEN" instead of "in",
+// e.g., "in.at/2026-10-17T09:00", or by starting them with a line like
+// "@at 09:00 tomorrow". WHEN can also be a time of day alone (its next
+// occurrence), "today" or "tomorrow" with a time of day, a unix timestamp, or
+// a duration like "+1h30m". Scheduled messages are listed in the "scheduled"
+// directory within the chat directory, in files named after the unix time at
+// which they will be sent and their id. Removing such a file cancels the
+// message, as does writing "cancel" followed by its name, or the message id,
+// to the chat's "ctl" file. Removing a chat directory recursively thus cancels
+// its scheduled messages too.
+//
+// For groups, the "members" directory within the chat directory has a file
+// per member, named like chat directories, containing the member's role
+// ("creator", "administrator", "member", "restricted", etc.). The "ctl" file
+// accepts the following administration commands:
+//
+//	add USER        add a user (handle or username) to the group
+//	kick USER       remove a user from the group
+//	title TEXT      change the chat title
+//	pin FILE        pin the message of a message file (relative path)
+//	unpin [FILE]    unpin the message, or all messages
+//
+// The "pinned" file within each chat directory lists the pinned messages, one
+// per line, as the names of their message files (relative to the chat
+// directory), or as their ids for messages we don't have. Writing the name of
+// a message file to it pins the message.
+//
+// The "draft" file within each chat directory contains the chat's draft in
+// Telegram, and is updated when the draft is changed from other Telegram
+// clients. Writing to it changes the draft in Telegram when the file is
+// closed; writing nothing to it (i.e., truncating it) deletes the draft.
+//
+// The "action" file within each chat directory shows what peers are doing,
+// one line per change, as the sender and the action (e.g., "typing",
+// "recording-voice-note", "uploading-document", or "cancel") separated by a
+// tab. Reads block like those of "out" files, and new readers first get the
+// last action. Conversely, while there is unsent data written to "in", peers
+// are told that we are typing.
+//
+// Secret chats have directories named after the user with a "secret-" prefix
+// (and the secret chat id as a suffix, if there already is one with the user),
+// which also contain a "state" file ("pending", "ready", or "closed"). Writing
+// "secret" to the "ctl" file of a private chat starts a secret chat with the
+// user. Self-destructing messages, and messages deleted from secret chats, are
+// removed from the file system and the database when Telegram deletes them.
+//
+// In supergroups with forum topics, each topic gets a subdirectory of the chat
+// directory, named after the topic, with its own message files and "in" and
+// "out" files. Messages written to a topic's "in" file are sent to that topic.
+//
+// The "events" file in the root directory is a stream of events across all
+// chats, which blocks like "out" files, but only delivers events that happen
+// after it is opened. Each event is a line of tab-separated fields: the kind of
+// event ("new", "edit", "delete", "read" for incoming messages we read, or
+// "seen" for outgoing messages the peer read), the chat directory name, the
+// message file name (relative to the chat directory), and the sender.
+//
+// The "users" directory in the root directory has a subdirectory per known
+// user, named like chat directories, with files "name", "username", "phone",
+// "status" (e.g., "online", "last seen 2026-10-17T09:00:00Z", or "recently"),
+// "bio", and "chat", which contains the name of the directory of the private
+// chat with the user, if any.
+//
+// Bots log in with the "bot_token" from the configuration file instead of a
+// phone number, and get a "bot" directory in the root directory, with files:
+//
+//	events      a stream of presses of inline keyboard buttons, one per line,
+//	            as the query id, the chat directory name, the message file
+//	            name, the sender, and the button data, separated by tabs
+//	answer      answers a button press, given a line with its query id,
+//	            optionally followed by a text to show, e.g., "123 Done"
+//	commands    the bot's commands, one per line, as the command and its
+//	            description separated by a space; writing to it replaces them
+//
+// Message texts are indexed for searching. Walking to "search/QUERY" in the
+// root directory, e.g., "ls 'search/lunch friday'", gives a directory with
+// copies of the message files containing all words in the query, named after
+// the chat directory and the message file. (These directories are not listed in
+// "search".) Alternatively, writing a query to "search/ctl" fills
+// "search/results" with the matching message files.
+//
 // Chats, messages, and users are all persisted across restarts in a Bolt
-// database stored at "$HOME/lib/telegramfs/history.bolt". Logs are stored in
-// "$HOME/lib/telegramfs/log".
+// database stored at "$HOME/lib/telegramfs/history.bolt", and tdlib keeps its
+// own database in "$HOME/lib/telegramfs/tdlib". With several accounts, these
+// are in a directory per account, e.g., "$HOME/lib/telegramfs/work". Logs are
+// stored in "$HOME/lib/telegramfs/log".
 //
 // The first time the command is run it will prompt Telegram to send you an
-// authorization code. You then run the command again using the -code flag to
-// pass the code. Subsequent invocations of the command do not need -code.
+// authorization code. You then write the code to the "auth/code" file, e.g.,
+// "echo 12345 > /mnt/telegram/auth/code". If two-step verification is on, you
+// are then asked for the password, which you write to "auth/password", and
+// new users are asked for a name, which you write as the first and last name
+// to "auth/register". The "auth/state" file shows what is asked for, e.g.,
+// "wait-code" or "wait-password" (with the password hint on the next line),
+// or "ready" once logged in. Writes to these files fail if Telegram rejects
+// what is written. Alternatively, you can run the command again using the
+// -code flag to pass the code, which is given to every account waiting for
+// one. Subsequent invocations of the command do not need -code.
+//
+// If no phone number is configured, telegramfs logs in by confirmation from a
+// device where you are already logged in, instead of with a code: it prints a
+// QR code on standard error, which is also in "auth/qr" (after the login link
+// it encodes), for you to scan with Telegram on that device, in Settings,
+// Devices, Link Desktop Device. The QR code is drawn for terminals with light
+// text on a dark background, and is replaced whenever Telegram renews the
+// link.
+//
+// The "status" file in the root shows "ready" when messages can be sent right
+// away. Otherwise, it shows the authorization state if not logged in, e.g.,
+// "wait-code" or "closed", or else the connection state, e.g., "connecting"
+// or "waiting-for-network". With several accounts, the "status" file in the
+// root has a line per account, with its name and status separated by a tab,
+// and each account directory has its own. Writes to "in" fail while not
+// logged in, but succeed while offline, the message being sent when back
+// online. If logged out, e.g., because the session was terminated from
+// another device, telegramfs logs in again as on the first run.
 //
 // You probably won't read message files one by one, but you can craft a helper
 // script for that. Here's mine, for example:
@@ -54,6 +211,24 @@
 //
 // and write to the "in" file in the same "my-contact" directory whenever you need to send a message to the chat.
 // (No need to use "tail -f", because reads will block until a new message arrives.)
+// Blocked reads are interrupted when flushed, when the file is closed, or when
+// the client disconnects. Optionally, they return end of file after a timeout
+// (see "out_timeout" in config.go).
+//
+// The "out" files keep only the most recent messages in memory (1000 by
+// default, see config.go). New readers of "out" get all of them, unless
+// configured otherwise, while "out.tail" only gets new messages and, e.g.,
+// "out.50" gets the last 50 messages followed by new ones. These variants are
+// not listed in the chat directories. The messages replayed by "out" can also
+// be changed for a single chat by writing to its "ctl" file, e.g.,
+//
+//	echo replay tail > my-contact/ctl
+//	echo replay 50 > my-contact/ctl
+//	echo replay since 2026-10-17T09:00:00Z > my-contact/ctl
+//	echo replay all > my-contact/ctl
+//
+// By default, messages read through "out" are not marked read in Telegram. Set
+// "mark_read_out" in the configuration file to change that.
 //
 // The script I use for chatting uses this latter approach, see telechat included in this repo.
 package main // import "github.com/nicolagi/telegramfs"
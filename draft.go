@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// draftOps is the file system node for the draft of a chat, which is kept in
+// sync with the draft in Telegram: changes from other Telegram clients replace
+// its contents, and its contents are saved in Telegram when the file is closed
+// after writing to it.
+type draftOps struct {
+	a      *account
+	chatID int64
+
+	mu       sync.Mutex
+	contents *nodes.RAMFile
+	mtime    uint32
+
+	// What was written through each fid, which is present if it wrote or
+	// truncated the file. It starts as a copy of the contents, and replaces
+	// them when the fid is closed.
+	written map[*srv.FFid]*nodes.RAMFile
+}
+
+func newDraftOps(a *account, chatID int64) *draftOps {
+	return &draftOps{
+		a:        a,
+		chatID:   chatID,
+		contents: nodes.NewRAMFile(nil),
+		written:  make(map[*srv.FFid]*nodes.RAMFile),
+	}
+}
+
+// file returns the contents as seen through the fid, i.e., what it wrote, if
+// anything. The caller must hold d.mu.
+func (d *draftOps) file(fid *srv.FFid) *nodes.RAMFile {
+	if f := d.written[fid]; f != nil {
+		return f
+	}
+	return d.contents
+}
+
+// edit returns what was written through the fid, starting with a copy of the
+// contents if needed. The caller must hold d.mu.
+func (d *draftOps) edit(fid *srv.FFid) *nodes.RAMFile {
+	f := d.written[fid]
+	if f == nil {
+		b := make([]byte, d.contents.Size())
+		_, _ = d.contents.ReadAt(b, 0)
+		f = nodes.NewRAMFile(b)
+		d.written[fid] = f
+	}
+	return f
+}
+
+// Stat implements srv.FStatOp.
+func (d *draftOps) Stat(fid *srv.FFid) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fid.F.Length = uint64(d.file(fid).Size())
+	fid.F.Mtime = d.mtime
+	fid.F.Atime = d.mtime
+	return nil
+}
+
+// Wstat implements srv.FWstatOp. It only allows truncating the contents to zero
+// length.
+func (d *draftOps) Wstat(fid *srv.FFid, dir *p.Dir) error {
+	if dir.ChangeLength() && dir.Length == 0 {
+		d.mu.Lock()
+		d.edit(fid).Truncate()
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (d *draftOps) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.file(fid).ReadAt(buf, int64(offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Write implements srv.FWriteOp.
+func (d *draftOps) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.edit(fid).WriteAt(data, int64(offset))
+	if n > 0 {
+		d.mtime = uint32(time.Now().Unix())
+	}
+	return n, err
+}
+
+// Clunk implements srv.FClunkOp. It saves the draft in Telegram if it was
+// written or truncated through the fid. An empty draft deletes the draft in
+// Telegram.
+func (d *draftOps) Clunk(fid *srv.FFid) error {
+	d.mu.Lock()
+	f := d.written[fid]
+	if f == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.written, fid)
+	d.contents = f
+	b := make([]byte, f.Size())
+	_, _ = f.ReadAt(b, 0)
+	d.mu.Unlock()
+	query := genericMap{
+		"@type":         "setChatDraftMessage",
+		"chat_id":       d.chatID,
+		"draft_message": nil,
+	}
+	if text := strings.TrimSpace(string(b)); text != "" {
+		query["draft_message"] = genericMap{
+			"@type": "draftMessage",
+			"input_message_text": genericMap{
+				"@type": "inputMessageText",
+				"text": genericMap{
+					"text": text,
+				},
+			},
+		}
+	}
+	d.a.send(query)
+	return nil
+}
+
+// FidDestroy implements srv.FDestroyOp. It forgets what was written through a
+// fid that was not closed, e.g., because its connection was lost.
+func (d *draftOps) FidDestroy(fid *srv.FFid) {
+	d.mu.Lock()
+	delete(d.written, fid)
+	d.mu.Unlock()
+}
+
+// Remove allows removing the file as part of removing its chat.
+func (d *draftOps) Remove(*srv.FFid) error {
+	return nil
+}
+
+// set replaces the contents with the draft from Telegram. Fids being used to
+// edit the file keep what they wrote.
+func (d *draftOps) set(text string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.contents.Truncate()
+	if text != "" {
+		_, _ = d.contents.WriteAt([]byte(text+"\n"), 0)
+	}
+	d.mtime = uint32(time.Now().Unix())
+}
+
+// setDraft updates the draft file of a chat, if the chat has a directory. The
+// draft is found at the given path in doc.
+func (a *account) setDraft(chatID int64, doc Document, path string) {
+	c := a.findChat(chatID)
+	if c == nil {
+		return
+	}
+	text, _ := doc.GetString(path + ".input_message_text.text.text")
+	c.Ops.(*chatOps).draft.set(strings.TrimSpace(text))
+}
+
+func (a *account) handleUpdateChatDraftMessage(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	a.setDraft(chatID, doc, "draft_message")
+}
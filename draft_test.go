@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func readDraft(t *testing.T, d *draftOps, fid *srv.FFid) string {
+	t.Helper()
+	buf := make([]byte, 100)
+	n, err := d.Read(fid, buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestDraftReaderClunk(t *testing.T) {
+	// Without an account, saving the draft would panic.
+	d := newDraftOps(nil, 1)
+	d.set("from the phone")
+	writer, reader := &srv.FFid{}, &srv.FFid{}
+	if _, err := d.Write(writer, []byte("FROM"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readDraft(t, d, writer); got != "FROM the phone\n" {
+		t.Errorf("got %q through the writer", got)
+	}
+	if got := readDraft(t, d, reader); got != "from the phone\n" {
+		t.Errorf("got %q through the reader", got)
+	}
+	if err := d.Clunk(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes from Telegram are seen by readers, but writers keep what they
+	// wrote.
+	d.set("changed on the phone")
+	if got := readDraft(t, d, reader); got != "changed on the phone\n" {
+		t.Errorf("got %q through the reader", got)
+	}
+	if got := readDraft(t, d, writer); got != "FROM the phone\n" {
+		t.Errorf("got %q through the writer", got)
+	}
+	d.FidDestroy(writer)
+	if len(d.written) != 0 {
+		t.Errorf("got %d edits, want none after the writer went away", len(d.written))
+	}
+	if got := readDraft(t, d, writer); got != "changed on the phone\n" {
+		t.Errorf("got %q, want the draft from Telegram", got)
+	}
+}
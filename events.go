@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newEventsOps returns the file system node for a stream of events, which only
+// delivers events that happen after it is opened. It serves the "events" file
+// in the root directory of an account, a stream of events across all its
+// chats. Each event is a line with tab-separated fields: the kind of event
+// ("new", "edit", "delete", "read", or "seen"), the chat handle, the message
+// file path relative to the chat directory, and the message sender. It also
+// serves "bot/events" (see bot.go).
+func newEventsOps(events *nodes.Stream) *nodes.StreamFile {
+	ops := nodes.NewStreamFile(events, func() nodes.Replay {
+		return nodes.Replay{Tail: true}
+	})
+	ops.Timeout = outTimeout()
+	return ops
+}
+
+// emitEvent appends an event about a message to the root events stream.
+func (a *account) emitEvent(kind string, chatID int64, messageID int64, sender string) {
+	handle := fmt.Sprintf("%d", chatID)
+	chat := a.findChat(chatID)
+	if chat != nil {
+		handle = chat.Name
+	}
+	var name string
+	if m := a.findMessage(messageID); m != nil {
+		name = relativePath(m.file, chat)
+	}
+	a.events.Append(nodes.Record{
+		Data: []byte(strings.Join([]string{kind, handle, name, sender}, "\t") + "\n"),
+	})
+}
+
+// relativePath returns the path of f relative to the directory dir, which
+// must be one of its ancestors.
+func relativePath(f *srv.File, dir *srv.File) string {
+	var elems []string
+	for ; f != dir && f != f.Parent; f = f.Parent {
+		elems = append([]string{f.Name}, elems...)
+	}
+	return path.Join(elems...)
+}
+
+// messageSender looks up the sender of a message in the database.
+func (a *account) messageSender(messageID int64) string {
+	var m tgMessage
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(messagesBucket).Get(id2key(messageID)); v != nil {
+			return json.Unmarshal(v, &m)
+		}
+		return nil
+	})
+	return m.Sender
+}
+
+func (a *account) handleUpdateDeleteMessages(doc Document) {
+	if permanent, _ := doc.GetBool("is_permanent"); !permanent {
+		return
+	}
+	chatID, _ := doc.GetInt64("chat_id")
+	messageIDs, ok := doc.GetInt64s("message_ids")
+	if !ok {
+		log.Print("Could not get ids of deleted messages")
+		return
+	}
+	secret := a.isSecretChat(chatID)
+	for _, id := range messageIDs {
+		if a.removeScheduled(id) {
+			// Sent or cancelled.
+			continue
+		}
+		a.emitEvent("delete", chatID, id, a.messageSender(id))
+		// Self-destructing messages are gone for good.
+		if secret || a.messageTTL(id) != 0 {
+			a.removeMessage(id)
+		}
+	}
+}
@@ -73,3 +73,51 @@ func (doc Document) GetInt64(path string) (int64, bool) {
 	f, typeMatches := doc.GetFloat64(path)
 	return int64(f), typeMatches
 }
+
+// GetInt64s returns the array at the given path as a slice of integers. Arrays
+// are not flattened, so the path must lead to the array itself.
+func (doc Document) GetInt64s(path string) ([]int64, bool) {
+	iv, present := doc[path]
+	if !present {
+		return nil, false
+	}
+	a, typeMatches := iv.([]interface{})
+	if !typeMatches {
+		return nil, false
+	}
+	v := make([]int64, 0, len(a))
+	for _, e := range a {
+		f, typeMatches := e.(float64)
+		if !typeMatches {
+			return nil, false
+		}
+		v = append(v, int64(f))
+	}
+	return v, true
+}
+
+// GetDocuments returns the objects in the array at the given path, each
+// flattened into a document whose keys are prefixed with prefix, e.g., with
+// prefix "message", the id of each object has key "message.id". This allows
+// handling objects in responses like those in updates.
+func (doc Document) GetDocuments(path string, prefix string) ([]Document, bool) {
+	iv, present := doc[path]
+	if !present {
+		return nil, false
+	}
+	a, typeMatches := iv.([]interface{})
+	if !typeMatches {
+		return nil, false
+	}
+	v := make([]Document, 0, len(a))
+	for _, e := range a {
+		nested, typeMatches := e.(map[string]interface{})
+		if !typeMatches {
+			return nil, false
+		}
+		d := make(Document)
+		d.recursivelyFlatten(nested, prefix)
+		v = append(v, d)
+	}
+	return v, true
+}
@@ -5,6 +5,7 @@ require (
 	github.com/lionkov/go9p v0.0.0-20190125202718-b4200817c487
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sys v0.0.0-20201109165425-215b40eba54c // indirect
+	rsc.io/qr v0.2.0
 )
 
 go 1.13
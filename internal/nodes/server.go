@@ -0,0 +1,206 @@
+package nodes
+
+import (
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// FLookupOp is implemented by the Ops of directories containing files that are
+// not listed, but are created on demand when walked to, e.g., files whose names
+// carry parameters. Lookup returns nil if there is no such file.
+type FLookupOp interface {
+	Lookup(dir *srv.File, name string) *srv.File
+}
+
+// FInterruptOp is implemented by the Ops of files whose reads may block.
+// InterruptibleRead is like the Read method of srv.FReadOp, but it must return
+// an error once intr is closed, which happens when the read is flushed or its
+// connection is closed. Since that may happen before InterruptibleRead is
+// even called, intr must be checked before blocking.
+type FInterruptOp interface {
+	InterruptibleRead(fid *srv.FFid, buf []byte, offset uint64, intr <-chan struct{}) (int, error)
+}
+
+// AddHidden initializes the fields of a file so that it belongs to dir, but
+// does not appear in its listing. It is meant to be used from FLookupOp
+// implementations.
+func AddHidden(f *srv.File, dir *srv.File, name string, uid p.User, gid p.Group, mode uint32, ops interface{}) {
+	_ = f.Add(nil, name, uid, gid, mode, ops)
+	f.Parent = dir
+}
+
+// Server is a srv.Fsrv that also keeps track of per-connection state, such as
+// the attach name (aname) each connection used, and of reads in progress, so
+// that they can be interrupted when flushed or when their connection is
+// closed.
+type Server struct {
+	*srv.Fsrv
+
+	mu      sync.Mutex
+	anames  map[*srv.Conn]string
+	pending map[*srv.Req]*pendingRead
+
+	// readHook, if not nil, is called by Read after the read has been
+	// recorded as pending and before it starts. It is used by tests.
+	readHook func(req *srv.Req)
+}
+
+// pendingRead is a read in progress of a file implementing FInterruptOp.
+type pendingRead struct {
+	intr        chan struct{} // Closed to interrupt the read.
+	interrupted bool
+	flushed     bool
+}
+
+// interrupt closes the interrupt channel of the read, unless already closed.
+// The caller must hold the server lock.
+func (pr *pendingRead) interrupt() {
+	if !pr.interrupted {
+		pr.interrupted = true
+		close(pr.intr)
+	}
+}
+
+// NewServer creates a file server with the given root directory.
+func NewServer(root *srv.File) *Server {
+	return &Server{
+		Fsrv:    srv.NewFileSrv(root),
+		anames:  make(map[*srv.Conn]string),
+		pending: make(map[*srv.Req]*pendingRead),
+	}
+}
+
+// Attach implements srv.ReqOps. It remembers the attach name.
+func (s *Server) Attach(req *srv.Req) {
+	s.mu.Lock()
+	s.anames[req.Conn] = req.Tc.Aname
+	s.mu.Unlock()
+	s.Fsrv.Attach(req)
+}
+
+// Walk implements srv.ReqOps. It is like (*srv.Fsrv).Walk, but it also walks
+// to the files created on demand by directories implementing FLookupOp.
+func (s *Server) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*srv.FFid)
+	tc := req.Tc
+
+	if req.Newfid.Aux == nil {
+		req.Newfid.Aux = &srv.FFid{Fid: req.Newfid}
+	}
+	nfid := req.Newfid.Aux.(*srv.FFid)
+
+	wqids := make([]p.Qid, len(tc.Wname))
+	i := 0
+	f := fid.F
+	for ; i < len(tc.Wname); i++ {
+		if tc.Wname[i] == ".." {
+			f = f.Parent
+			wqids[i] = f.Qid
+			continue
+		}
+		if f.Qid.Type&p.QTDIR != 0 && !f.CheckPerm(req.Fid.User, p.DMEXEC) {
+			break
+		}
+		child := f.Find(tc.Wname[i])
+		if child == nil {
+			if op, ok := f.Ops.(FLookupOp); ok {
+				child = op.Lookup(f, tc.Wname[i])
+			}
+		}
+		if child == nil {
+			break
+		}
+		f = child
+		wqids[i] = f.Qid
+	}
+
+	if len(tc.Wname) > 0 && i == 0 {
+		req.RespondError(srv.Enoent)
+		return
+	}
+
+	nfid.F = f
+	req.RespondRwalk(wqids[0:i])
+}
+
+// Read implements srv.ReqOps. Reads of files implementing FInterruptOp are
+// kept track of while in progress, and if they are flushed, they are answered
+// only once they return.
+func (s *Server) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*srv.FFid)
+	iop, ok := fid.F.Ops.(FInterruptOp)
+	if !ok {
+		s.Fsrv.Read(req)
+		return
+	}
+	pr := &pendingRead{intr: make(chan struct{})}
+	s.mu.Lock()
+	s.pending[req] = pr
+	s.mu.Unlock()
+	if err := p.InitRread(req.Rc, req.Tc.Count); err != nil {
+		s.mu.Lock()
+		delete(s.pending, req)
+		s.mu.Unlock()
+		req.RespondError(err)
+		return
+	}
+	if s.readHook != nil {
+		s.readHook(req)
+	}
+	n, err := iop.InterruptibleRead(fid, req.Rc.Data, req.Tc.Offset, pr.intr)
+	s.mu.Lock()
+	delete(s.pending, req)
+	flushed := pr.flushed
+	s.mu.Unlock()
+	switch {
+	case flushed:
+		req.Flush()
+	case err != nil:
+		req.RespondError(err)
+	default:
+		p.SetRreadCount(req.Rc, uint32(n))
+		req.Respond()
+	}
+}
+
+// Flush implements srv.FlushOp. It interrupts the flushed read, if any.
+func (s *Server) Flush(req *srv.Req) {
+	s.mu.Lock()
+	pr := s.pending[req]
+	if pr != nil {
+		pr.flushed = true
+		pr.interrupt()
+	}
+	s.mu.Unlock()
+	if pr == nil {
+		req.Flush()
+	}
+}
+
+// ConnOpened implements srv.ConnOps.
+func (s *Server) ConnOpened(*srv.Conn) {}
+
+// ConnClosed implements srv.ConnOps. It interrupts the reads in progress on
+// the connection.
+func (s *Server) ConnClosed(conn *srv.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.anames, conn)
+	for req, pr := range s.pending {
+		if req.Conn == conn {
+			pr.interrupt()
+		}
+	}
+}
+
+// Aname returns the attach name used by the connection the fid belongs to.
+func (s *Server) Aname(fid *srv.FFid) string {
+	if fid == nil || fid.Fid == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.anames[fid.Fid.Fconn]
+}
@@ -0,0 +1,257 @@
+package nodes
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+type testUser string
+
+func (u testUser) Name() string            { return string(u) }
+func (testUser) Id() int                   { return -1 }
+func (u testUser) Groups() []p.Group       { return []p.Group{u} }
+func (u testUser) IsMember(g p.Group) bool { return g.Name() == string(u) }
+func (u testUser) Members() []p.User       { return []p.User{u} }
+
+type testUsers struct{}
+
+func (testUsers) Uid2User(int) p.User             { return nil }
+func (testUsers) Uname2User(name string) p.User   { return testUser(name) }
+func (testUsers) Gid2Group(int) p.Group           { return nil }
+func (testUsers) Gname2Group(name string) p.Group { return testUser(name) }
+
+// fakeClient speaks just enough 9P2000 to exercise the server, including
+// messages that the go9p client doesn't send, like Tflush.
+type fakeClient struct {
+	t       *testing.T
+	conn    net.Conn
+	replies chan *p.Fcall
+}
+
+const (
+	rootFid = 1
+	outFid  = 2
+)
+
+// newTestServer serves a root directory containing a stream file called "out"
+// to a fake client, which is attached with the given aname and has walked to
+// and opened "out".
+func newTestServer(t *testing.T, aname string) (*Server, *StreamFile, *fakeClient) {
+	root := &srv.File{}
+	_ = root.Add(nil, "/", testUser("tester"), testUser("tester"), p.DMDIR|0555, nil)
+	out := NewStreamFile(NewStream(10), nil)
+	_ = (&srv.File{}).Add(root, "out", testUser("tester"), testUser("tester"), 0444, out)
+	s := NewServer(root)
+	s.Dotu = false
+	s.Upool = testUsers{}
+	s.Start(s)
+
+	clientEnd, serverEnd := net.Pipe()
+	s.NewConn(serverEnd)
+	c := &fakeClient{t: t, conn: clientEnd, replies: make(chan *p.Fcall, 10)}
+	go c.recv()
+
+	c.rpc(p.NOTAG, p.Rversion, func(fc *p.Fcall) error { return p.PackTversion(fc, 8192, "9P2000") })
+	c.rpc(1, p.Rattach, func(fc *p.Fcall) error {
+		return p.PackTattach(fc, rootFid, p.NOFID, "tester", aname, p.NOUID, false)
+	})
+	c.rpc(1, p.Rwalk, func(fc *p.Fcall) error { return p.PackTwalk(fc, rootFid, outFid, []string{"out"}) })
+	c.rpc(1, p.Ropen, func(fc *p.Fcall) error { return p.PackTopen(fc, outFid, p.OREAD) })
+	return s, out, c
+}
+
+func (c *fakeClient) recv() {
+	defer close(c.replies)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.LittleEndian.Uint32(size[:]))
+		copy(buf, size[:])
+		if _, err := io.ReadFull(c.conn, buf[4:]); err != nil {
+			return
+		}
+		fc, err, _ := p.Unpack(buf, false)
+		if err != nil {
+			c.t.Errorf("could not unpack reply: %v", err)
+			return
+		}
+		c.replies <- fc
+	}
+}
+
+func (c *fakeClient) send(tag uint16, pack func(*p.Fcall) error) {
+	c.t.Helper()
+	fc := p.NewFcall(8192 + p.IOHDRSZ)
+	if err := pack(fc); err != nil {
+		c.t.Fatal(err)
+	}
+	p.SetTag(fc, tag)
+	if _, err := c.conn.Write(fc.Pkt); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *fakeClient) expect(tag uint16, typ uint8) *p.Fcall {
+	c.t.Helper()
+	select {
+	case fc := <-c.replies:
+		if fc == nil {
+			c.t.Fatal("connection closed")
+		}
+		if fc.Tag != tag || fc.Type != typ {
+			c.t.Fatalf("got %v, want type %d and tag %d", fc, typ, tag)
+		}
+		return fc
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for reply of type %d with tag %d", typ, tag)
+		return nil
+	}
+}
+
+func (c *fakeClient) expectNothing() {
+	c.t.Helper()
+	select {
+	case fc := <-c.replies:
+		c.t.Fatalf("got unexpected reply %v", fc)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (c *fakeClient) rpc(tag uint16, typ uint8, pack func(*p.Fcall) error) *p.Fcall {
+	c.t.Helper()
+	c.send(tag, pack)
+	return c.expect(tag, typ)
+}
+
+func readOut(fc *p.Fcall) error {
+	return p.PackTread(fc, outFid, 0, 100)
+}
+
+// waitIdle waits until the server has no reads in progress.
+func waitIdle(t *testing.T, s *Server) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		s.mu.Lock()
+		n := len(s.pending)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("blocked read was not interrupted")
+}
+
+func TestServerFlushInterruptsRead(t *testing.T) {
+	s, out, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	c.send(2, readOut)
+	c.expectNothing()
+	c.rpc(3, p.Rflush, func(fc *p.Fcall) error { return p.PackTflush(fc, 2) })
+	waitIdle(t, s)
+	c.expectNothing()
+
+	// The fid is still usable.
+	c.send(4, readOut)
+	out.Stream.Append(Record{Data: []byte("hello\n")})
+	if got := string(c.expect(4, p.Rread).Data); got != "hello\n" {
+		t.Errorf("got %q, want %q", got, "hello\n")
+	}
+}
+
+func TestServerFlushBeforeRead(t *testing.T) {
+	s, _, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	// Flush the read after it is recorded as pending, but before the file's
+	// read method gets a chance to block.
+	s.readHook = func(req *srv.Req) {
+		c.send(3, func(fc *p.Fcall) error { return p.PackTflush(fc, 2) })
+		for {
+			s.mu.Lock()
+			interrupted := s.pending[req].interrupted
+			s.mu.Unlock()
+			if interrupted {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	c.send(2, readOut)
+	c.expect(3, p.Rflush)
+	waitIdle(t, s)
+	c.expectNothing()
+}
+
+func TestServerFlushInterruptsOnlyFlushedRead(t *testing.T) {
+	s, out, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	c.send(2, readOut)
+	c.send(3, readOut)
+	c.expectNothing()
+	c.rpc(4, p.Rflush, func(fc *p.Fcall) error { return p.PackTflush(fc, 2) })
+	c.expectNothing()
+	out.Stream.Append(Record{Data: []byte("hello\n")})
+	if got := string(c.expect(3, p.Rread).Data); got != "hello\n" {
+		t.Errorf("got %q, want %q", got, "hello\n")
+	}
+	waitIdle(t, s)
+}
+
+func TestServerClunkInterruptsRead(t *testing.T) {
+	s, _, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	c.send(2, readOut)
+	c.expectNothing()
+	c.send(3, func(fc *p.Fcall) error { return p.PackTclunk(fc, outFid) })
+	replies := map[uint16]uint8{}
+	for i := 0; i < 2; i++ {
+		select {
+		case fc := <-c.replies:
+			replies[fc.Tag] = fc.Type
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	if replies[2] != p.Rerror || replies[3] != p.Rclunk {
+		t.Errorf("got replies %v", replies)
+	}
+	waitIdle(t, s)
+}
+
+func TestServerDisconnectInterruptsRead(t *testing.T) {
+	s, _, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	c.send(2, readOut)
+	c.expectNothing()
+	_ = c.conn.Close()
+	waitIdle(t, s)
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	_, out, c := newTestServer(t, "")
+	defer func() { _ = c.conn.Close() }()
+	out.Timeout = 10 * time.Millisecond
+	if got := c.rpc(2, p.Rread, readOut).Count; got != 0 {
+		t.Errorf("got %d bytes, want 0", got)
+	}
+}
+
+func TestServerAname(t *testing.T) {
+	s, out, c := newTestServer(t, "backup")
+	defer func() { _ = c.conn.Close() }()
+	var got string
+	out.OnRead = func(fid *srv.FFid, _ []int64) { got = s.Aname(fid) }
+	out.Stream.Append(Record{Data: []byte("hello\n"), Key: 1})
+	c.rpc(2, p.Rread, readOut)
+	if got != "backup" {
+		t.Errorf("got aname %q, want %q", got, "backup")
+	}
+}
@@ -0,0 +1,343 @@
+package nodes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Record is a unit of data appended to a Stream, e.g., a formatted message.
+type Record struct {
+	Data []byte
+	Time time.Time
+	// Key optionally identifies the record, e.g., by message id, and is
+	// reported to StreamFile.OnRead once the record is delivered. Records with
+	// a zero Key are not reported.
+	Key int64
+}
+
+// Stream is a bounded, append-only log of records. Only the most recent
+// records are retained. Offsets in the stream grow forever, even though the
+// oldest records are discarded.
+type Stream struct {
+	mu      sync.Mutex
+	ring    []streamRecord
+	head    int    // Index of the oldest record in ring.
+	count   int    // Number of records in ring.
+	base    uint64 // Offset of the oldest record.
+	end     uint64 // Offset just past the newest record.
+	mtime   uint32
+	changed chan struct{} // Closed (and replaced) on append.
+}
+
+type streamRecord struct {
+	Record
+	off uint64
+}
+
+// NewStream creates a stream retaining at most capacity records.
+func NewStream(capacity int) *Stream {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Stream{
+		ring:    make([]streamRecord, capacity),
+		changed: make(chan struct{}),
+	}
+}
+
+// Append adds a record to the stream, discarding the oldest one if the stream
+// is full, and wakes up blocked readers.
+func (s *Stream) Append(r Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == len(s.ring) {
+		s.head = (s.head + 1) % len(s.ring)
+		s.count--
+		s.base = s.at(0).off
+	}
+	s.ring[(s.head+s.count)%len(s.ring)] = streamRecord{Record: r, off: s.end}
+	s.count++
+	s.end += uint64(len(r.Data))
+	s.mtime = uint32(time.Now().Unix())
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// at returns the i-th oldest record. The caller must hold s.mu.
+func (s *Stream) at(i int) *streamRecord {
+	return &s.ring[(s.head+i)%len(s.ring)]
+}
+
+// find returns the index of the record containing the given offset, which
+// must lie between s.base and s.end. The caller must hold s.mu.
+func (s *Stream) find(off uint64) int {
+	return sort.Search(s.count, func(i int) bool {
+		return s.at(i).off+uint64(len(s.at(i).Data)) > off
+	})
+}
+
+// start returns the offset at which a reader with the given replay settings
+// starts. The caller must hold s.mu.
+func (s *Stream) start(r Replay) uint64 {
+	if r.Tail {
+		return s.end
+	}
+	first := 0
+	if r.Last > 0 && r.Last < s.count {
+		first = s.count - r.Last
+	}
+	if !r.Since.IsZero() {
+		for first < s.count && s.at(first).Time.Before(r.Since) {
+			first++
+		}
+	}
+	if first == s.count {
+		return s.end
+	}
+	return s.at(first).off
+}
+
+// Replay determines which of the records retained by a stream a new reader
+// gets before the ones appended after it opened the file.
+type Replay struct {
+	Tail  bool      // If set, no retained records.
+	Last  int       // If positive, at most this many of the retained records.
+	Since time.Time // If not zero, only records from this time on.
+}
+
+// ParseReplay parses replay settings, which are one of "all", "tail", a number
+// of records, or "since" followed by a time, which is either a unix timestamp
+// or in RFC 3339 format.
+func ParseReplay(s string) (Replay, error) {
+	var r Replay
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 1 && fields[0] == "all":
+	case len(fields) == 1 && fields[0] == "tail":
+		r.Tail = true
+	case len(fields) == 2 && fields[0] == "since":
+		if unix, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			r.Since = time.Unix(unix, 0)
+		} else if t, err := time.Parse(time.RFC3339, fields[1]); err == nil {
+			r.Since = t
+		} else {
+			return r, fmt.Errorf("bad time %q", fields[1])
+		}
+	case len(fields) == 1:
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n <= 0 {
+			return r, fmt.Errorf("bad replay %q", s)
+		}
+		r.Last = n
+	default:
+		return r, fmt.Errorf("bad replay %q", s)
+	}
+	return r, nil
+}
+
+func (r Replay) String() string {
+	switch {
+	case r.Tail:
+		return "tail"
+	case !r.Since.IsZero():
+		return fmt.Sprintf("since %d", r.Since.Unix())
+	case r.Last > 0:
+		return strconv.Itoa(r.Last)
+	default:
+		return "all"
+	}
+}
+
+// ErrInterrupted is returned by blocked reads that are interrupted.
+var ErrInterrupted = errors.New("interrupted")
+
+// StreamFile is a read-only file node reading from a Stream. Reads past the
+// end of the stream block until more records are appended, the timeout
+// expires, or they are interrupted (see FInterruptOp). Each open of the file
+// has its own cursor, starting at the position determined by the replay
+// settings at the time of opening.
+//
+// StreamFile implements srv.FOpenOp, srv.FReadOp, srv.FStatOp,
+// srv.FClunkOp, srv.FDestroyOp, and FInterruptOp.
+type StreamFile struct {
+	Stream *Stream
+
+	// Timeout, if positive, is how long reads block before returning no
+	// data, which clients see as the end of the file.
+	Timeout time.Duration
+
+	// Replay returns the replay settings for a new reader. If nil, readers
+	// get all retained records.
+	Replay func() Replay
+
+	// OnRead, if not nil, is called after each read with the keys of the
+	// records whose last byte was delivered by the read.
+	OnRead func(fid *srv.FFid, keys []int64)
+
+	mu      sync.Mutex
+	cursors map[*srv.FFid]uint64        // Stream offset corresponding to file offset 0.
+	closing map[*srv.FFid]chan struct{} // Closed when the fid goes away.
+}
+
+// NewStreamFile creates a file reading from the given stream.
+func NewStreamFile(s *Stream, replay func() Replay) *StreamFile {
+	return &StreamFile{
+		Stream:  s,
+		Replay:  replay,
+		cursors: make(map[*srv.FFid]uint64),
+		closing: make(map[*srv.FFid]chan struct{}),
+	}
+}
+
+// closed returns a channel that is closed when the given fid is clunked or
+// destroyed.
+func (f *StreamFile) closed(fid *srv.FFid) <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.closing[fid]
+	if c == nil {
+		c = make(chan struct{})
+		f.closing[fid] = c
+	}
+	return c
+}
+
+// cursor returns the stream offset corresponding to the start of the file for
+// the given fid, initializing it if needed.
+func (f *StreamFile) cursor(fid *srv.FFid) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	start, ok := f.cursors[fid]
+	if !ok {
+		var r Replay
+		if f.Replay != nil {
+			r = f.Replay()
+		}
+		s := f.Stream
+		s.mu.Lock()
+		start = s.start(r)
+		s.mu.Unlock()
+		f.cursors[fid] = start
+	}
+	return start
+}
+
+// Open implements srv.FOpenOp.
+func (f *StreamFile) Open(fid *srv.FFid, _ uint8) error {
+	f.mu.Lock()
+	delete(f.cursors, fid)
+	f.mu.Unlock()
+	f.cursor(fid)
+	f.closed(fid)
+	return nil
+}
+
+// Stat implements srv.FStatOp.
+func (f *StreamFile) Stat(fid *srv.FFid) error {
+	f.mu.Lock()
+	start, ok := f.cursors[fid]
+	f.mu.Unlock()
+	s := f.Stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok || start < s.base {
+		start = s.base
+	}
+	fid.F.Length = s.end - start
+	fid.F.Mtime = s.mtime
+	fid.F.Atime = s.mtime
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (f *StreamFile) Read(fid *srv.FFid, p []byte, off uint64) (int, error) {
+	return f.InterruptibleRead(fid, p, off, nil)
+}
+
+// InterruptibleRead implements FInterruptOp.
+func (f *StreamFile) InterruptibleRead(fid *srv.FFid, p []byte, off uint64, intr <-chan struct{}) (int, error) {
+	start := f.cursor(fid)
+	closed := f.closed(fid)
+	var timeout <-chan time.Time
+	if f.Timeout > 0 {
+		timer := time.NewTimer(f.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	s := f.Stream
+	s.mu.Lock()
+	pos := start + off
+	for {
+		if pos < s.base {
+			// The records this reader was about to get have been discarded.
+			// Skip to the oldest retained one.
+			pos = s.base
+		}
+		if pos < s.end {
+			break
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-intr:
+			return 0, ErrInterrupted
+		case <-closed:
+			return 0, ErrInterrupted
+		default:
+		}
+		select {
+		case <-changed:
+		case <-intr:
+			return 0, ErrInterrupted
+		case <-closed:
+			return 0, ErrInterrupted
+		case <-timeout:
+			return 0, nil
+		}
+		s.mu.Lock()
+	}
+	var n int
+	var keys []int64
+	for i := s.find(pos); i < s.count && n < len(p); i++ {
+		r := s.at(i)
+		n += copy(p[n:], r.Data[pos+uint64(n)-r.off:])
+		if r.Key != 0 && pos+uint64(n) == r.off+uint64(len(r.Data)) {
+			keys = append(keys, r.Key)
+		}
+	}
+	s.mu.Unlock()
+	if pos != start+off {
+		f.mu.Lock()
+		f.cursors[fid] = pos - off
+		f.mu.Unlock()
+	}
+	if f.OnRead != nil && len(keys) > 0 {
+		f.OnRead(fid, keys)
+	}
+	return n, nil
+}
+
+// Clunk implements srv.FClunkOp. It interrupts blocked reads of the fid.
+func (f *StreamFile) Clunk(fid *srv.FFid) error {
+	f.FidDestroy(fid)
+	return nil
+}
+
+// FidDestroy implements srv.FDestroyOp. It interrupts blocked reads of the
+// fid.
+func (f *StreamFile) FidDestroy(fid *srv.FFid) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.closing[fid]; c != nil {
+		close(c)
+		delete(f.closing, fid)
+	}
+	delete(f.cursors, fid)
+}
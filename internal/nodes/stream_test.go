@@ -0,0 +1,99 @@
+package nodes
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func readAll(t *testing.T, f *StreamFile, fid *srv.FFid, size int) string {
+	t.Helper()
+	p := make([]byte, size)
+	n, err := f.Read(fid, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p[:n])
+}
+
+func TestStreamReplay(t *testing.T) {
+	s := NewStream(3)
+	t0 := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		s.Append(Record{
+			Data: []byte(fmt.Sprintf("%d\n", i)),
+			Time: t0.Add(time.Duration(i) * time.Second),
+		})
+	}
+	for _, c := range []struct {
+		replay string
+		want   string
+	}{
+		{"all", "2\n3\n4\n"},
+		{"2", "3\n4\n"},
+		{"10", "2\n3\n4\n"},
+		{"since 1004", "4\n"},
+	} {
+		r, err := ParseReplay(c.replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewStreamFile(s, func() Replay { return r })
+		fid := &srv.FFid{F: &srv.File{}}
+		if err := f.Open(fid, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, f, fid, 100); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.replay, got, c.want)
+		}
+	}
+}
+
+func TestStreamTail(t *testing.T) {
+	s := NewStream(10)
+	s.Append(Record{Data: []byte("old\n")})
+	var keys []int64
+	f := NewStreamFile(s, func() Replay { return Replay{Tail: true} })
+	f.OnRead = func(_ *srv.FFid, k []int64) { keys = append(keys, k...) }
+	fid := &srv.FFid{F: &srv.File{}}
+	if err := f.Open(fid, 0); err != nil {
+		t.Fatal(err)
+	}
+	go s.Append(Record{Data: []byte("new\n"), Key: 42})
+	if got, want := readAll(t, f, fid, 2), "ne"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got keys %v before the record was delivered", keys)
+	}
+	p := make([]byte, 10)
+	if n, _ := f.Read(fid, p, 2); string(p[:n]) != "w\n" {
+		t.Errorf("got %q, want %q", p[:n], "w\n")
+	}
+	if len(keys) != 1 || keys[0] != 42 {
+		t.Errorf("got keys %v, want [42]", keys)
+	}
+}
+
+func TestStreamInterruptedBeforeRead(t *testing.T) {
+	f := NewStreamFile(NewStream(10), nil)
+	fid := &srv.FFid{F: &srv.File{}}
+	if err := f.Open(fid, 0); err != nil {
+		t.Fatal(err)
+	}
+	intr := make(chan struct{})
+	close(intr)
+	if _, err := f.InterruptibleRead(fid, make([]byte, 10), 0, intr); err != ErrInterrupted {
+		t.Errorf("got error %v, want %v", err, ErrInterrupted)
+	}
+}
+
+func TestParseReplay(t *testing.T) {
+	for _, bad := range []string{"", "0", "-1", "since", "since yesterday", "all tail"} {
+		if _, err := ParseReplay(bad); err == nil {
+			t.Errorf("%q: got nil error", bad)
+		}
+	}
+}
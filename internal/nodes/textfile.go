@@ -0,0 +1,63 @@
+package nodes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// TextFile is a read-only file whose contents are replaced as a whole, e.g.,
+// to reflect some state that changes over time. It implements srv.FReadOp and
+// srv.FStatOp, and it is safe for concurrent use.
+type TextFile struct {
+	mu       sync.Mutex
+	contents []byte
+	mtime    uint32
+}
+
+// NewTextFile creates a TextFile with the given initial contents.
+func NewTextFile(contents []byte) *TextFile {
+	f := &TextFile{}
+	f.Set(contents)
+	return f
+}
+
+// Set replaces the contents of the file. It does not retain the passed slice.
+func (f *TextFile) Set(contents []byte) {
+	b := make([]byte, len(contents))
+	copy(b, contents)
+	f.mu.Lock()
+	f.contents = b
+	f.mtime = uint32(time.Now().Unix())
+	f.mu.Unlock()
+}
+
+// Bytes returns a copy of the contents of the file.
+func (f *TextFile) Bytes() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := make([]byte, len(f.contents))
+	copy(b, f.contents)
+	return b
+}
+
+// Stat implements srv.FStatOp.
+func (f *TextFile) Stat(fid *srv.FFid) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fid.F.Length = uint64(len(f.contents))
+	fid.F.Mtime = f.mtime
+	fid.F.Atime = f.mtime
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (f *TextFile) Read(_ *srv.FFid, p []byte, off uint64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= uint64(len(f.contents)) {
+		return 0, nil
+	}
+	return copy(p, f.contents[off:]), nil
+}
@@ -0,0 +1,29 @@
+package nodes
+
+import (
+	"testing"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestTextFile(t *testing.T) {
+	f := NewTextFile([]byte("hello"))
+	fid := &srv.FFid{F: &srv.File{}}
+	if err := f.Stat(fid); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fid.F.Length, uint64(5); got != want {
+		t.Errorf("got %d, want %d (length)", got, want)
+	}
+	p := make([]byte, 3)
+	if n, _ := f.Read(fid, p, 2); string(p[:n]) != "llo" {
+		t.Errorf("got %q, want %q", p[:n], "llo")
+	}
+	f.Set([]byte("hi"))
+	if n, _ := f.Read(fid, p, 2); n != 0 {
+		t.Errorf("got %d, want 0 (read past the end)", n)
+	}
+	if got, want := string(f.Bytes()), "hi"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
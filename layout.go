@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// latestCount is the number of messages in "latest" directories.
+const latestCount = 20
+
+// dateLayout keeps track of the directories of a chat (or topic) directory
+// when using the date layout (see config.go): the YYYY/MM/DD directories
+// containing message files, and the "latest" and "today" directories
+// containing copies of the most recent and today's message files.
+type dateLayout struct {
+	chat   *srv.File
+	latest *srv.File
+	today  *srv.File
+
+	mu          sync.Mutex
+	latestFiles []*messageCopies // Oldest first.
+	todayFiles  []*messageCopies
+	todayDate   string
+}
+
+// messageCopies are the files in "latest" or "today" for a message.
+type messageCopies struct {
+	when  time.Time
+	files []*srv.File
+}
+
+// dirOps is the file system node for directories that only serve to organize
+// other files.
+type dirOps struct{}
+
+// Lookup implements nodes.FLookupOp like for chat directories, so that aliases
+// of message files in YYYY/MM/DD directories can be walked to.
+func (dirOps) Lookup(dir *srv.File, name string) *srv.File {
+	return lookup(dir, name)
+}
+
+// Remove allows removing the directory as part of removing its chat.
+func (dirOps) Remove(*srv.FFid) error {
+	return nil
+}
+
+// todayOps is the file system node for "today" directories.
+type todayOps struct {
+	dirOps
+	layout *dateLayout
+}
+
+// Open implements srv.FOpenOp. It empties the directory if its contents are
+// not from today.
+func (t *todayOps) Open(*srv.FFid, uint8) error {
+	t.layout.mu.Lock()
+	defer t.layout.mu.Unlock()
+	t.layout.checkToday()
+	return nil
+}
+
+// messageCopyOps is the file system node for copies of message files. It
+// behaves like the original, except that removing it removes only the copy.
+type messageCopyOps struct {
+	*messageOps
+}
+
+// Remove removes the copy of the message file only.
+func (messageCopyOps) Remove(*srv.FFid) error {
+	return nil
+}
+
+// getLayout returns the date layout for a chat (or topic) directory, creating
+// the "latest" and "today" directories if needed.
+func (a *account) getLayout(chat *srv.File) *dateLayout {
+	l := a.layouts[chat]
+	if l != nil {
+		return l
+	}
+	l = &dateLayout{chat: chat}
+	l.latest = newFile()
+	_ = l.latest.Add(chat, "latest", user, group, p.DMDIR|0555, dirOps{})
+	l.today = newFile()
+	_ = l.today.Add(chat, "today", user, group, p.DMDIR|0555, &todayOps{layout: l})
+	a.layouts[chat] = l
+	l.emptyTodayAtMidnight()
+	return l
+}
+
+// emptyTodayAtMidnight empties the "today" directory when the date changes,
+// every day, in case it's not opened (see todayOps.Open) and no messages
+// arrive.
+func (l *dateLayout) emptyTodayAtMidnight() {
+	now := time.Now()
+	// A second later, in case the timer fires early according to the clock.
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 1, 0, now.Location())
+	time.AfterFunc(midnight.Sub(now), func() {
+		l.mu.Lock()
+		l.checkToday()
+		l.mu.Unlock()
+		l.emptyTodayAtMidnight()
+	})
+}
+
+// dayDir returns the YYYY/MM/DD directory for the given time, creating it if
+// needed.
+func (l *dateLayout) dayDir(when time.Time) *srv.File {
+	dir := l.chat
+	for _, name := range []string{
+		fmt.Sprintf("%04d", when.Year()),
+		fmt.Sprintf("%02d", when.Month()),
+		fmt.Sprintf("%02d", when.Day()),
+	} {
+		sub := dir.Find(name)
+		if sub == nil {
+			sub = newFile()
+			_ = sub.Add(dir, name, user, group, p.DMDIR|0777, dirOps{})
+		}
+		dir = sub
+	}
+	return dir
+}
+
+// addMessage adds copies of the files of a message to the "latest" and
+// "today" directories, if appropriate. The message files are f (text) and jf
+// (JSON).
+func (l *dateLayout) addMessage(m *tgMessage, f *srv.File, jf *srv.File) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	full := len(l.latestFiles) >= latestCount
+	if !full || m.When.After(l.latestFiles[0].when) {
+		l.latestFiles = addCopies(l.latestFiles, l.latest, m, f, jf)
+		if len(l.latestFiles) > latestCount {
+			removeCopies(l.latestFiles[0])
+			l.latestFiles = l.latestFiles[1:]
+		}
+	}
+	l.checkToday()
+	if m.When.Format("2006-01-02") == l.todayDate {
+		l.todayFiles = addCopies(l.todayFiles, l.today, m, f, jf)
+	}
+}
+
+// checkToday empties the "today" directory if its contents are stale. The
+// caller must hold l.mu.
+func (l *dateLayout) checkToday() {
+	today := time.Now().Format("2006-01-02")
+	if l.todayDate == today {
+		return
+	}
+	for _, c := range l.todayFiles {
+		removeCopies(c)
+	}
+	l.todayFiles = nil
+	l.todayDate = today
+}
+
+// addCopies adds copies of a message's files to dir, keeping the copies
+// sorted by time.
+func addCopies(copies []*messageCopies, dir *srv.File, m *tgMessage, f *srv.File, jf *srv.File) []*messageCopies {
+	c := &messageCopies{when: m.When}
+	for _, orig := range []*srv.File{f, jf} {
+		ops := orig.Ops
+		if mo, ok := ops.(*messageOps); ok {
+			ops = messageCopyOps{mo}
+		}
+		cf := newFile()
+		if err := cf.Add(dir, orig.Name, user, group, orig.Mode, ops); err != nil {
+			continue
+		}
+		cf.Mtime = orig.Mtime
+		cf.Atime = orig.Atime
+		c.files = append(c.files, cf)
+	}
+	i := sort.Search(len(copies), func(i int) bool {
+		return copies[i].when.After(m.When)
+	})
+	copies = append(copies, nil)
+	copy(copies[i+1:], copies[i:])
+	copies[i] = c
+	return copies
+}
+
+// removeMessageCopies removes the copies of the files of a message from all
+// "latest" and "today" directories.
+func (a *account) removeMessageCopies(m *messageOps) {
+	for _, l := range a.layouts {
+		l.mu.Lock()
+		l.latestFiles = withoutCopies(l.latestFiles, m)
+		l.todayFiles = withoutCopies(l.todayFiles, m)
+		l.mu.Unlock()
+	}
+}
+
+func withoutCopies(copies []*messageCopies, m *messageOps) []*messageCopies {
+	kept := copies[:0]
+	for _, c := range copies {
+		isCopy := false
+		for _, f := range c.files {
+			if mc, ok := f.Ops.(messageCopyOps); ok && mc.messageOps == m {
+				isCopy = true
+			}
+		}
+		if isCopy {
+			removeCopies(c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func removeCopies(c *messageCopies) {
+	for _, f := range c.files {
+		f.Remove()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+func TestDateLayout(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	config = &tgConfig{Layout: "date", MessageNames: "unix-id"}
+	defer func() { config = &tgConfig{} }()
+	now := time.Now()
+	a.handleUpdateNewMessage(mustDocument(t, fmt.Sprintf(`{"message": {"@type": "message", "id": 100, "chat_id": 42, "date": %d, "content": {"text": {"text": "hi"}}}}`, now.Unix())))
+	c := a.findChat(42)
+	if c == nil {
+		t.Fatal("no chat directory")
+	}
+	name := fmt.Sprintf("%d-100.txt", now.Unix())
+	day := c
+	for _, dir := range []string{now.Format("2006"), now.Format("01"), now.Format("02")} {
+		if day = day.Find(dir); day == nil {
+			t.Fatalf("%q not found", dir)
+		}
+	}
+	f := day.Find(name)
+	if f == nil {
+		t.Fatalf("%q not found in %s/%s/%s", name, now.Format("2006"), now.Format("01"), now.Format("02"))
+	}
+	alias := fmt.Sprintf("%d.txt", now.Unix())
+	if got := day.Ops.(nodes.FLookupOp).Lookup(day, alias); got != f {
+		t.Errorf("looking up %q got %v, want the message file", alias, got)
+	}
+	for _, dir := range []string{"latest", "today"} {
+		if c.Find(dir).Find(name) == nil {
+			t.Errorf("%q not found in %q", name, dir)
+		}
+	}
+
+	// Once the date changes, "today" is emptied.
+	l := a.layouts[c]
+	l.mu.Lock()
+	l.todayDate = "2006-01-02"
+	l.checkToday()
+	l.mu.Unlock()
+	if got := c.Find("today").Find(name); got != nil {
+		t.Errorf("%q still in today", name)
+	}
+	if c.Find("latest").Find(name) == nil {
+		t.Errorf("%q not found in latest", name)
+	}
+}
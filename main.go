@@ -14,7 +14,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/lionkov/go9p/p"
 	"github.com/lionkov/go9p/p/srv"
@@ -36,18 +35,22 @@ var (
 	user  = identity("telegram")
 	group = identity("telegram")
 
-	// The Bolt database for persistence, divided into three buckets.
-	database       *bolt.DB
-	usersBucket    = []byte("users") // maps ids to handles
+	// The buckets of the Bolt databases of accounts (see account.go).
+	usersBucket    = []byte("users") // maps ids to users (see users.go)
 	chatsBucket    = []byte("chats") // maps handles to ids
 	messagesBucket = []byte("messages")
+	topicsBucket   = []byte("topics")     // maps chat and thread ids to topic names
+	indexBucket    = []byte("index")      // maps words and message ids to nothing (see search.go)
+	outboxBucket   = []byte("outbox")     // maps ids to messages not yet sent (see outbox.go)
+	secretBucket   = []byte("secret")     // maps secret chat ids to secret chats (see secret.go)
+	secretIDBucket = []byte("secret-ids") // maps chat ids of secret chats to secret chat ids
 
-	// The Telegram client (from tdlib).
-	client unsafe.Pointer
+	// The file server.
+	fileServer *nodes.Server
 
-	// The file system root node.
-	root     *srv.File
-	msgNodes = make(map[int64]*messageOps)
+	// The messages replayed to new readers of "out" files, unless changed via
+	// "ctl" files.
+	defaultReplay nodes.Replay
 
 	// The authorization code command line option.
 	authorizationCode string
@@ -57,27 +60,68 @@ var (
 
 // chatOps is the file system node for a directory of messages that belong to a single chat.
 type chatOps struct {
-	chatID int64
+	a       *account
+	chatID  int64
+	unread  *nodes.TextFile
+	pending *nodes.TextFile
+	draft   *draftOps
+	actions *nodes.Stream
+	pinned  *pinnedOps
+}
+
+func newChatOps(a *account, chatID int64) *chatOps {
+	return &chatOps{
+		a:       a,
+		chatID:  chatID,
+		unread:  nodes.NewTextFile(nil),
+		pending: nodes.NewTextFile(nil),
+		draft:   newDraftOps(a, chatID),
+		actions: nodes.NewStream(100),
+	}
 }
 
-func newChatOps(chatID int64) *chatOps {
-	return &chatOps{chatID: chatID}
+// Lookup implements nodes.FLookupOp.
+func (c *chatOps) Lookup(dir *srv.File, name string) *srv.File {
+	return lookup(dir, name)
 }
 
 // Removes allows removing a chat from the database (not from Telegram).
 func (c *chatOps) Remove(f *srv.FFid) error {
-	return database.Update(func(tx *bolt.Tx) error {
+	c.a.chatDirsMu.Lock()
+	if c.a.chatDirs[c.chatID] == f.F {
+		delete(c.a.chatDirs, c.chatID)
+	}
+	c.a.chatDirsMu.Unlock()
+	return c.a.database.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket(chatsBucket).Delete([]byte(f.F.Name))
 	})
 }
 
+// findMessage returns the node for the given message, or nil if there is none.
+func (a *account) findMessage(messageID int64) *messageOps {
+	a.msgNodesMu.Lock()
+	defer a.msgNodesMu.Unlock()
+	return a.msgNodes[messageID]
+}
+
+// findChat returns the directory for the given chat, or nil if there is none.
+func (a *account) findChat(chatID int64) *srv.File {
+	a.chatDirsMu.Lock()
+	defer a.chatDirsMu.Unlock()
+	return a.chatDirs[chatID]
+}
+
 // messageOps is a read-only file system node for messages. When a file is read
-// and closed, it is marked read in Telegram.
+// and closed, it is marked read in Telegram (see marksRead).
 type messageOps struct {
+	a          *account
+	file       *srv.File
 	chatID     int64
 	messageID  int64
+	when       int64 // The unix timestamp of the message.
 	isOutgoing bool
 	contents   *nodes.RAMFile
+	json       *messageJSONOps
 	modified   bool
 
 	// 0 not read
@@ -102,13 +146,13 @@ func (m *messageOps) Wstat(_ *srv.FFid, dir *p.Dir) error {
 }
 
 // Read implements srv.FReadOp.
-func (m *messageOps) Read(_ *srv.FFid, buf []byte, offset uint64) (int, error) {
+func (m *messageOps) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
 	n, err := m.contents.ReadAt(buf, int64(offset))
 	// In 9P, we don't answer with Rerror when we get to EOF!
 	if err == io.EOF {
 		err = nil
 	}
-	if n > 0 {
+	if n > 0 && marksRead(fid) {
 		if m.state == 0 {
 			m.state++
 		}
@@ -128,7 +172,7 @@ func (m *messageOps) Write(fid *srv.FFid, data []byte, offset uint64) (int, erro
 // Clunk implements srv.FClunkOp.
 func (m *messageOps) Clunk(*srv.FFid) error {
 	if m.state == 1 {
-		tgSend(client, genericMap{
+		m.a.send(genericMap{
 			"@type":       "viewMessages",
 			"chat_id":     m.chatID,
 			"message_ids": []int64{m.messageID},
@@ -161,23 +205,12 @@ func (m *messageOps) Clunk(*srv.FFid) error {
 		// https://pastebin.com/Z4cpncZ1
 	} else {
 		// Reply to message
-		tgSend(client, genericMap{
-			"@type":               "sendMessage",
-			"chat_id":             m.chatID,
-			"reply_to_message_id": m.messageID,
-			"input_message_content": genericMap{
-				"@type": "inputMessageText",
-				"text": genericMap{
-					"text": edited.String(),
-				},
-				// To send formatted code and other things, I'd need to send an entities property,
-				// containing offsets, lengths, and types of the entities. See:
-				// https://core.telegram.org/tdlib/docs/classtd_1_1td__api_1_1formatted_text.html
-			},
-		})
+		if err := m.a.sendText(outboxEntry{ChatID: m.chatID, ReplyToID: m.messageID, Text: edited.String()}); err != nil {
+			return err
+		}
 	}
 	m.modified = false
-	return database.View(func(tx *bolt.Tx) error {
+	return m.a.database.View(func(tx *bolt.Tx) error {
 		v := tx.Bucket(messagesBucket).Get(id2key(m.messageID))
 		var msg tgMessage
 		if err := json.Unmarshal(v, &msg); err != nil {
@@ -192,56 +225,145 @@ func (m *messageOps) Clunk(*srv.FFid) error {
 // Remove removes a message from the database, not from Telegram, and removes
 // the node from the filesystem.
 func (m *messageOps) Remove(*srv.FFid) error {
-	return database.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(messagesBucket).Delete(id2key(m.messageID))
+	return m.a.deleteMessage(m.messageID)
+}
+
+// deleteMessage deletes a message from the database.
+func (a *account) deleteMessage(messageID int64) error {
+	return a.database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket)
+		if v := bucket.Get(id2key(messageID)); v != nil {
+			var msg tgMessage
+			if err := json.Unmarshal(v, &msg); err == nil {
+				unindexMessage(tx, &msg)
+			}
+		}
+		return bucket.Delete(id2key(messageID))
 	})
 }
 
+// messageJSONOps is a read-only file system node for a message in JSON format,
+// as a machine-readable alternative to messageOps.
+type messageJSONOps struct {
+	*nodes.TextFile
+}
+
+// Remove allows removing the file, e.g., as part of removing its chat.
+func (*messageJSONOps) Remove(*srv.FFid) error {
+	return nil
+}
+
 // outOps is a read-only file system node for reading messages as they come.
+// The stream of messages is shared by the chat's "out" file and its variants
+// (see lookupOut), which differ in the messages replayed to new readers.
 type outOps struct {
+	*nodes.StreamFile
+	a      *account
 	chatID int64
+
 	mu     sync.Mutex
-	cond   *sync.Cond
-	buf    []byte
-	mtime  uint32
+	replay nodes.Replay
 }
 
-func newOutOps(chatID int64) *outOps {
-	var ops outOps
-	ops.chatID = chatID
-	ops.cond = sync.NewCond(&ops.mu)
-	return &ops
+func newOutOps(a *account, chatID int64, stream *nodes.Stream, replay nodes.Replay) *outOps {
+	ops := &outOps{
+		a:      a,
+		chatID: chatID,
+		replay: replay,
+	}
+	ops.StreamFile = nodes.NewStreamFile(stream, ops.getReplay)
+	ops.Timeout = outTimeout()
+	ops.OnRead = ops.markDelivered
+	return ops
 }
 
-func (c *outOps) Stat(fid *srv.FFid) error {
-	fid.F.Length = uint64(len(c.buf))
-	fid.F.Mtime = c.mtime
-	fid.F.Atime = c.mtime
-	return nil
+func (c *outOps) getReplay() nodes.Replay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replay
 }
 
-func (c *outOps) Read(_ *srv.FFid, p []byte, off uint64) (int, error) {
+func (c *outOps) setReplay(r nodes.Replay) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	blen := uint64(len(c.buf))
-	for off >= blen {
-		c.cond.Wait()
-		blen = uint64(len(c.buf))
+	c.replay = r
+	c.mu.Unlock()
+}
+
+// markDelivered marks the incoming messages delivered to a reader as read, if
+// so configured.
+func (c *outOps) markDelivered(fid *srv.FFid, messageIDs []int64) {
+	if !config.MarkReadOut || !marksRead(fid) {
+		return
 	}
-	n := copy(p, c.buf[off:])
-	return n, nil
+	c.a.send(genericMap{
+		"@type":       "viewMessages",
+		"chat_id":     c.chatID,
+		"message_ids": messageIDs,
+		"force_read":  true,
+	})
+}
+
+// lookup implements nodes.FLookupOp for chat and topic directories, and for
+// the directories organizing their message files (see dirOps).
+func lookup(dir *srv.File, name string) *srv.File {
+	if f := lookupOut(dir, name); f != nil {
+		return f
+	}
+	if f := lookupInAt(dir, name); f != nil {
+		return f
+	}
+	return lookupAlias(dir, name)
 }
 
-// inOps is a write-only file system node for sending messages to a chat.
+// lookupOut is used by lookup. It provides variants of the "out" file that
+// differ in the messages replayed to new readers: "out.tail" (none) and
+// "out.N" (the last N messages).
+func lookupOut(dir *srv.File, name string) *srv.File {
+	if !strings.HasPrefix(name, "out.") {
+		return nil
+	}
+	spec := strings.TrimPrefix(name, "out.")
+	replay, err := nodes.ParseReplay(spec)
+	if err != nil || (!replay.Tail && replay.Last == 0) {
+		return nil
+	}
+	f := dir.Find("out")
+	if f == nil {
+		return nil
+	}
+	out, ok := f.Ops.(*outOps)
+	if !ok {
+		return nil
+	}
+	f = newFile()
+	nodes.AddHidden(f, dir, name, user, group, 0444, newOutOps(out.a, out.chatID, out.Stream, replay))
+	return f
+}
+
+// inOps is a write-only file system node for sending messages to a chat, or
+// to a forum topic within a chat if threadID is not zero. Messages are
+// scheduled for sendAt if it is not zero, or for the time in an "@at" first
+// line (see scheduleHeader).
 type inOps struct {
-	chatID int64
-	b      *bytes.Buffer
+	a        *account
+	chatID   int64
+	threadID int64
+	sendAt   time.Time
+
+	// What was written through each fid that is not yet closed, and a channel
+	// closed when the last of them goes away, to stop telling Telegram we are
+	// typing (see compose).
+	mu        sync.Mutex
+	written   map[*srv.FFid]*bytes.Buffer
+	composing chan struct{}
 }
 
-func newInOps(chatID int64) *inOps {
+func newInOps(a *account, chatID int64, threadID int64) *inOps {
 	return &inOps{
-		chatID: chatID,
-		b:      bytes.NewBuffer(nil),
+		a:        a,
+		chatID:   chatID,
+		threadID: threadID,
+		written:  make(map[*srv.FFid]*bytes.Buffer),
 	}
 }
 
@@ -252,10 +374,33 @@ func (c *inOps) Wstat(*srv.FFid, *p.Dir) error {
 	return nil
 }
 
-// Write implements srv.FWriteOp. It appends the data to a buffer for sending
-// when the file is released. The offset is ignored.
-func (c *inOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
-	return c.b.Write(data)
+// Write implements srv.FWriteOp. It fails unless we are logged in (see
+// checkAuthorized). Otherwise, it appends the data to a buffer of the fid for
+// sending when the fid is closed. The offset is ignored. A malformed "@at"
+// first line is rejected as soon as it's complete, and discards the message.
+func (c *inOps) Write(fid *srv.FFid, data []byte, _ uint64) (int, error) {
+	if err := c.a.checkAuthorized(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.written[fid]
+	if b == nil {
+		b = new(bytes.Buffer)
+		c.written[fid] = b
+	}
+	if c.composing == nil {
+		c.composing = make(chan struct{})
+		go c.compose(c.composing)
+	}
+	n, _ := b.Write(data)
+	if i := bytes.IndexByte(b.Bytes(), '\n'); i >= 0 {
+		if _, _, err := scheduleHeader(string(b.Bytes()[:i+1])); err != nil {
+			b.Reset()
+			return 0, err
+		}
+	}
+	return n, nil
 }
 
 // Read implements srv.FReadOp, and represents an empty file.
@@ -264,24 +409,33 @@ func (c *inOps) Read(*srv.FFid, []byte, uint64) (int, error) {
 }
 
 // Clunk implements srv.FClunkOp. It checks if anything was written to the chat
-// by the file server user, in which case, the contents need to be sent via
-// Telegram.
-func (c *inOps) Clunk(*srv.FFid) error {
-	if c.b.Len() <= 0 {
+// through the fid, in which case, the contents need to be sent via Telegram
+// (see sendText). Nothing is sent when closing a fid that didn't write, e.g.,
+// one opened for reading.
+func (c *inOps) Clunk(fid *srv.FFid) error {
+	c.mu.Lock()
+	b := c.written[fid]
+	c.stopComposing(fid)
+	c.mu.Unlock()
+	if b == nil || b.Len() == 0 {
 		return nil
 	}
-	tgSend(client, genericMap{
-		"@type":   "sendMessage",
-		"chat_id": c.chatID,
-		"input_message_content": genericMap{
-			"@type": "inputMessageText",
-			"text": genericMap{
-				"text": c.b.String(),
-			},
-		},
-	})
-	c.b.Truncate(0)
-	return nil
+	text, sendAt, err := scheduleHeader(b.String())
+	if err != nil {
+		return err
+	}
+	if sendAt.IsZero() {
+		sendAt = c.sendAt
+	}
+	e := outboxEntry{
+		ChatID:   c.chatID,
+		ThreadID: c.threadID,
+		Text:     text,
+	}
+	if !sendAt.IsZero() {
+		e.SendAt = sendAt.Unix()
+	}
+	return c.a.sendText(e)
 }
 
 // Remove allows removing the control file. This makes it possibly to remove
@@ -295,81 +449,67 @@ func main() {
 	flag.StringVar(&authorizationCode, "code", "", "authorization `code` (needed only once)")
 	flag.Parse()
 
-	client = tgClient()
-
-	tgExecute(client, genericMap{
-		"@type":               "setLogVerbosityLevel",
-		"new_verbosity_level": 2,
-	})
-
 	config = mustLoadConfig(*configPath)
-	database = mustSetupDatabase()
-
-	root = newFile()
-	_ = root.Add(nil, "root", user, group, p.DMDIR|0777, nil)
-
-	addHistory(root)
-
-	// Spawn goroutine handlign incoming events from Telegram.
-	// It won't exit until the program is killed or the main goroutine exits.
-	go func() {
-		m := make(map[string]int)
-		lastLogged := time.Now()
-		for {
-			event := tgReceive(client)
-			if event == "" {
-				continue
-			}
-
-			eventJSON, err := NewDocument(event)
-			if err != nil {
-				log.Printf("Could not make JSON document: %v", err)
-				continue
-			}
-
-			eventType, ok := eventJSON.GetString("@type")
-			if !ok {
-				log.Printf(`Could not extract string "@type"`)
-				continue
-			}
+	if config.OutReplay != "" {
+		var err error
+		if defaultReplay, err = nodes.ParseReplay(config.OutReplay); err != nil {
+			log.Fatalf("Could not parse out_replay: %v", err)
+		}
+	}
 
-			switch eventType {
-			case "updateUser":
-				handleUpdateUser(eventJSON)
-			case "updateNewMessage":
-				handleUpdateNewMessage(eventJSON)
-			case "updateMessageContent":
-				handleUpdateMessageContent(eventJSON)
-			case "updateAuthorizationState":
-				handleUpdateAuthorizationState(eventJSON)
-			default:
-				m[eventType]++
-				if time.Since(lastLogged) > 5*time.Minute {
-					if len(m) > 0 {
-						var b bytes.Buffer
-						for e, c := range m {
-							fmt.Fprintf(&b, ", %s=%d", e, c)
-							delete(m, e)
-						}
-						log.Printf("Unhandled event types: %s", b.Bytes()[2:])
-					}
-					lastLogged = time.Now()
-				}
+	// A single account is served at the root, several accounts each in a
+	// directory of the root.
+	var root *srv.File
+	var accounts []*account
+	for _, conf := range accountConfigs(config) {
+		a := newAccount(conf, os.ExpandEnv("$HOME/lib/telegramfs"))
+		if a.name == "" {
+			a.addRoot(nil)
+			root = a.root
+		} else {
+			if root == nil {
+				root = newFile()
+				_ = root.Add(nil, "root", user, group, p.DMDIR|0555, dirOps{})
 			}
+			a.addRoot(root)
 		}
-	}()
+		accounts = append(accounts, a)
+	}
+	if root != accounts[0].root {
+		addRootStatus(root, accounts)
+	}
 
-	fsrv := srv.NewFileSrv(root)
-	// fsrv.Debuglevel = srv.DbgPrintFcalls
-	fsrv.Dotu = false
-	fsrv.Start(fsrv)
-	fsrv.Id = "telegram"
+	// Spawn goroutines handling incoming events from Telegram.
+	for _, a := range accounts {
+		go a.run()
+	}
+
+	fileServer = nodes.NewServer(root)
+	// fileServer.Debuglevel = srv.DbgPrintFcalls
+	fileServer.Dotu = false
+	fileServer.Start(fileServer)
+	fileServer.Id = "telegram"
 	// This is a blocking call. The program will be terminated by sending a signal.
-	if err := fsrv.StartNetListener("tcp", config.ListenAddr); err != nil {
+	if err := fileServer.StartNetListener("tcp", config.ListenAddr); err != nil {
 		log.Fatalf("Could not listen on %q: %v", config.ListenAddr, err)
 	}
 }
 
+// marksRead tells whether reads through the given fid should mark messages
+// read in Telegram.
+func marksRead(fid *srv.FFid) bool {
+	if config.NoMarkRead {
+		return false
+	}
+	aname := fileServer.Aname(fid)
+	for _, quiet := range config.QuietAnames {
+		if aname == quiet {
+			return false
+		}
+	}
+	return true
+}
+
 func mustLoadConfig(path string) *tgConfig {
 	var config tgConfig
 	f, err := os.Open(path)
@@ -382,14 +522,17 @@ func mustLoadConfig(path string) *tgConfig {
 	return &config
 }
 
-func mustSetupDatabase() *bolt.DB {
-	path := os.ExpandEnv("$HOME/lib/telegramfs/history.bolt")
-	db, err := bolt.Open(path, 0600, nil)
+func mustSetupDatabase(path string) *bolt.DB {
+	// Time out rather than wait forever if another process has the database
+	// open.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		log.Fatalf("Could not open Bolt database file %q: %v", path, err)
 	}
 	if err := db.Update(func(tx *bolt.Tx) error {
 		var err error
+		needsIndex := tx.Bucket(indexBucket) == nil
+		needsSecretIDs := tx.Bucket(secretIDBucket) == nil
 		if err == nil {
 			_, err = tx.CreateBucketIfNotExists(chatsBucket)
 		}
@@ -399,6 +542,27 @@ func mustSetupDatabase() *bolt.DB {
 		if err == nil {
 			_, err = tx.CreateBucketIfNotExists(usersBucket)
 		}
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(topicsBucket)
+		}
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(indexBucket)
+		}
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(outboxBucket)
+		}
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(secretBucket)
+		}
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(secretIDBucket)
+		}
+		if err == nil && needsIndex {
+			err = indexAllMessages(tx)
+		}
+		if err == nil && needsSecretIDs {
+			err = indexAllSecretChats(tx)
+		}
 		return err
 	}); err != nil {
 		log.Fatalf("Could not ensure database buckets exist: %v", err)
@@ -406,22 +570,34 @@ func mustSetupDatabase() *bolt.DB {
 	return db
 }
 
-// The update user messages are used to maintain a mapping from user ids to
-// their handles.
-func handleUpdateUser(doc Document) {
-	err := database.Update(func(tx *bolt.Tx) error {
+// The update user messages are used to maintain the user records, which map
+// user ids to their handles, among other things (see users.go).
+func (a *account) handleUpdateUser(doc Document) {
+	var u *tgUser
+	err := a.database.Update(func(tx *bolt.Tx) error {
 		id, ok := doc.GetInt64("user.id")
 		if !ok {
 			return errors.New("could not extract user id")
 		}
+		users := tx.Bucket(usersBucket)
+		u = getUser(users, id)
+		if u == nil {
+			u = &tgUser{ID: id}
+		}
+		u.FirstName, _ = doc.GetString("user.first_name")
+		u.LastName, _ = doc.GetString("user.last_name")
+		u.Username, ok = doc.GetString("user.username")
+		if !ok {
+			// Newer tdlib versions.
+			u.Username, _ = doc.GetString("user.usernames.editable_username")
+		}
+		u.Phone, _ = doc.GetString("user.phone_number")
+		u.Status = statusString(doc, "user.status")
 		// Prefer $first_$last then $first then $last then $username.
 		var handle string
-		first, _ := doc.GetString("user.first_name")
-		last, _ := doc.GetString("user.last_name")
-		username, _ := doc.GetString("user.username")
-		first = strings.ToLower(first)
-		last = strings.ToLower(last)
-		username = strings.ToLower(username)
+		first := strings.ToLower(u.FirstName)
+		last := strings.ToLower(u.LastName)
+		username := strings.ToLower(u.Username)
 		if first != "" && last != "" {
 			handle = fmt.Sprintf("%s-%s", first, last)
 		} else if first != "" && last == "" {
@@ -431,19 +607,21 @@ func handleUpdateUser(doc Document) {
 		} else {
 			handle = username
 		}
-		handle = strings.TrimSpace(handle)
-		handle = strings.Replace(handle, " ", "-", -1)
-		if len(handle) == 0 {
+		u.Handle = toHandle(handle)
+		if len(u.Handle) == 0 {
+			u = nil
 			return errors.New("could not extract a handle for the user")
 		}
-		return tx.Bucket(usersBucket).Put(id2key(id), []byte(handle))
+		return putUser(users, u)
 	})
 	if err != nil {
 		log.Printf("Could not handle update user message: %v", err)
+		return
 	}
+	a.addUserDir(u)
 }
 
-func handleUpdateNewMessage(doc Document) {
+func (a *account) handleUpdateNewMessage(doc Document) {
 	kind, ok := doc.GetString("message.@type")
 	if !ok {
 		log.Print("Could not get message type")
@@ -453,7 +631,11 @@ func handleUpdateNewMessage(doc Document) {
 		log.Printf("Unhandled update type for new message: %q", kind)
 		return
 	}
-	err := database.Update(func(tx *bolt.Tx) error {
+	if _, scheduled := doc.GetString("message.scheduling_state.@type"); scheduled {
+		a.addScheduled(doc)
+		return
+	}
+	err := a.database.Update(func(tx *bolt.Tx) error {
 		messages := tx.Bucket(messagesBucket)
 		users := tx.Bucket(usersBucket)
 		chats := tx.Bucket(chatsBucket)
@@ -468,8 +650,26 @@ func handleUpdateNewMessage(doc Document) {
 		m.When = time.Unix(whenUnix, 0)
 		m.Text, _ = doc.GetString("message.content.text.text")
 		m.Text = strings.TrimSpace(m.Text)
-		replyToMessageID, isReply := doc.GetInt64("message.reply_to_message_id")
-		if isReply {
+		m.IsPinned, _ = doc.GetBool("message.is_pinned")
+		m.TTL, _ = doc.GetInt64("message.ttl")
+		if m.TTL == 0 {
+			// Newer tdlib versions.
+			m.TTL, _ = doc.GetInt64("message.self_destruct_type.self_destruct_time")
+		}
+		if isTopic, _ := doc.GetBool("message.is_topic_message"); isTopic {
+			m.ThreadID, _ = doc.GetInt64("message.message_thread_id")
+		}
+		if kind, _ := doc.GetString("message.content.@type"); kind == "messageForumTopicCreated" {
+			// The message creating a topic is the first message of its thread.
+			name, _ := doc.GetString("message.content.name")
+			if err := putTopicName(tx, m.ChatID, m.ID, name); err != nil {
+				return err
+			}
+			m.ThreadID = m.ID
+		}
+		replyToMessageID, _ := doc.GetInt64("message.reply_to_message_id")
+		if replyToMessageID != 0 {
+			m.ReplyToID = replyToMessageID
 			rb := messages.Get(id2key(replyToMessageID))
 			if rb != nil {
 				var rm tgMessage
@@ -483,13 +683,16 @@ func handleUpdateNewMessage(doc Document) {
 			}
 		}
 
-		handle := users.Get(id2key(m.ChatID))
-		m.Sender = string(users.Get(id2key(senderID)))
+		handle := chatHandle(tx, m.ChatID)
+		m.Sender = string(getHandle(users, senderID))
 
 		b, _ := json.Marshal(m)
 		if err := messages.Put(id2key(m.ID), b); err != nil {
 			return err
 		}
+		if err := indexMessage(tx, &m); err != nil {
+			return err
+		}
 
 		// Remember chat across restarts
 		if handle != nil {
@@ -502,17 +705,16 @@ func handleUpdateNewMessage(doc Document) {
 			handle = id2key(m.ChatID)
 		}
 
-		c := root.Find(string(handle))
+		c := a.findChat(m.ChatID)
 		if c == nil {
-			c = newFile()
-			_ = c.Add(root, string(handle), user, group, p.DMDIR|0777, newChatOps(m.ChatID))
-			// A write-only file to send new messages to the chat.
-			in := newFile()
-			_ = in.Add(c, "in", user, group, 0666, newInOps(m.ChatID))
-			out := newFile()
-			_ = out.Add(c, "out", user, group, 0444, newOutOps(m.ChatID))
-		}
-		addMessage(c, &m)
+			c = a.addChat(string(handle), m.ChatID)
+		}
+		if m.ThreadID != 0 {
+			c = a.topicDir(tx, c, m.ChatID, m.ThreadID)
+		}
+		a.addMessage(c, &m)
+		a.refreshUnread(m.ChatID)
+		a.emitEvent("new", m.ChatID, m.ID, m.Sender)
 		return nil
 	})
 	if err != nil {
@@ -520,11 +722,11 @@ func handleUpdateNewMessage(doc Document) {
 	}
 }
 
-func handleUpdateMessageContent(doc Document) {
+func (a *account) handleUpdateMessageContent(doc Document) {
 	messageID, _ := doc.GetInt64("message_id")
 	newText, _ := doc.GetString("new_content.text.text")
 
-	err := database.Update(func(tx *bolt.Tx) error {
+	err := a.database.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(messagesBucket)
 		key := id2key(messageID)
 		value := bucket.Get(key)
@@ -536,12 +738,18 @@ func handleUpdateMessageContent(doc Document) {
 		if err := json.Unmarshal(value, &m); err != nil {
 			return err
 		}
+		unindexMessage(tx, &m)
 		m.Text = strings.TrimSpace(newText)
-		if ops := msgNodes[messageID]; ops != nil {
+		if err := indexMessage(tx, &m); err != nil {
+			return err
+		}
+		if ops := a.findMessage(messageID); ops != nil {
 			ops.contents.Truncate()
 			_, _ = ops.contents.WriteAt(getFormattedText(&m), 0)
+			ops.json.Set(getJSON(&m))
 		}
 		value, _ = json.Marshal(&m)
+		a.emitEvent("edit", m.ChatID, m.ID, m.Sender)
 		return bucket.Put(key, value)
 	})
 	if err != nil {
@@ -549,69 +757,17 @@ func handleUpdateMessageContent(doc Document) {
 	}
 }
 
-func handleUpdateAuthorizationState(j Document) {
-	kind, ok := j.GetString("authorization_state.@type")
-	if !ok {
-		log.Println("no auth state type")
-		return
-	}
-	switch kind {
-	case "authorizationStateWaitCode":
-		if authorizationCode == "" {
-			fmt.Fprintf(os.Stderr, `Telegram requires an authorization code, which should have been sent now.
-We're terminating telegramfs right now, please restart it passing the code via the '-code' command line option.
-This is only needed once, i.e., after successful authorization, you don't need to use the '-code' option, and it will be ignored.`)
-			os.Exit(1)
-		}
-		tgSend(client, genericMap{
-			"@type": "checkAuthenticationCode",
-			"code":  authorizationCode,
-		})
-	case "authorizationStateWaitPhoneNumber":
-		tgSend(client, genericMap{
-			"@type":        "setAuthenticationPhoneNumber",
-			"phone_number": config.Phone,
-		})
-	case "authorizationStateWaitEncryptionKey":
-		tgSend(client, genericMap{
-			"@type": "checkDatabaseEncryptionKey",
-			"key":   config.Key,
-		})
-	case "authorizationStateWaitTdlibParameters":
-		tgSend(client, genericMap{
-			"@type": "setTdlibParameters",
-			"parameters": genericMap{
-				"database_directory":       os.ExpandEnv("$HOME/lib/telegramfs/tdlib"),
-				"use_message_database":     true,
-				"use_secret_chats":         true,
-				"api_id":                   config.APIId,
-				"api_hash":                 config.APIHash,
-				"system_language_code":     "en",
-				"device_model":             "Desktop",
-				"system_version":           "Unknown",
-				"application_version":      "1.0",
-				"enable_storage_optimizer": true,
-			},
-		})
-	default:
-		log.Printf("Unhandled authorization state message type: %v", kind)
-	}
-}
-
-// addHistory assumes the root is indeed the file system root node, that it's empty,
-// that the database has been opened and all buckets exist (possibly empty).
-func addHistory(root *srv.File) {
-	err := database.View(func(tx *bolt.Tx) error {
+// addHistory assumes the root is indeed the account's root node, that it has no
+// chats, that the database has been opened and all buckets exist (possibly
+// empty).
+func (a *account) addHistory() {
+	err := a.database.View(func(tx *bolt.Tx) error {
 		err := tx.Bucket(chatsBucket).ForEach(func(handle, chatID []byte) error {
-			c := newFile()
-			_ = c.Add(root, string(handle), user, group, p.DMDIR|0777, newChatOps(key2id(chatID)))
+			c := a.addChat(string(handle), key2id(chatID))
 			// Set timestamps to 0, so they will be updated by the messages that
 			// will be added below.
 			c.Mtime = 0
 			c.Atime = 0
-			cid := key2id(chatID)
-			_ = newFile().Add(c, "in", user, group, 0666, newInOps(cid))
-			_ = newFile().Add(c, "out", user, group, 0444, newOutOps(cid))
 			return nil
 		})
 		if err != nil {
@@ -629,13 +785,12 @@ func addHistory(root *srv.File) {
 		if err != nil {
 			return err
 		}
-		users := tx.Bucket(usersBucket)
 		for _, m := range mm {
-			handle := users.Get(id2key(m.ChatID))
-			if handle == nil {
-				handle = id2key(m.ChatID)
+			c := a.findChat(m.ChatID)
+			if m.ThreadID != 0 {
+				c = a.topicDir(tx, c, m.ChatID, m.ThreadID)
 			}
-			addMessage(root.Find(string(handle)), m)
+			a.addMessage(c, m)
 		}
 		return nil
 	})
@@ -644,6 +799,12 @@ func addHistory(root *srv.File) {
 	}
 }
 
+// getJSON returns the message as a line of JSON.
+func getJSON(m *tgMessage) []byte {
+	b, _ := json.Marshal(m)
+	return append(b, '\n')
+}
+
 func getTextWithAuthor(m *tgMessage) []byte {
 	var b bytes.Buffer
 	indentPrefix := "> "
@@ -679,31 +840,107 @@ func addPrefix(t, p string) []byte {
 	return b.Bytes()
 }
 
-// addMessage assumes chat is a chat directory.
-func addMessage(chat *srv.File, m *tgMessage) {
+// addChat creates the directory for a chat in the account's root, along with
+// its "in" and "out" files.
+func (a *account) addChat(handle string, chatID int64) *srv.File {
+	c := newFile()
+	ops := newChatOps(a, chatID)
+	_ = c.Add(a.root, handle, user, group, p.DMDIR|0777, ops)
+	ops.pinned = &pinnedOps{TextFile: nodes.NewTextFile(nil), a: a, chatID: chatID, dir: c}
+	// A write-only file to send new messages to the chat.
+	_ = newFile().Add(c, "in", user, group, 0666, newInOps(a, chatID, 0))
+	a.addOutFiles(c, chatID)
+	_ = newFile().Add(c, "unread", user, group, 0444, ops.unread)
+	_ = newFile().Add(c, "pending", user, group, 0444, ops.pending)
+	_ = newFile().Add(c, "scheduled", user, group, p.DMDIR|0777, dirOps{})
+	_ = newFile().Add(c, "draft", user, group, 0666, ops.draft)
+	_ = newFile().Add(c, "action", user, group, 0444, newActionOps(ops.actions))
+	_ = newFile().Add(c, "members", user, group, p.DMDIR|0555, &membersOps{a: a, chatID: chatID})
+	_ = newFile().Add(c, "pinned", user, group, 0666, ops.pinned)
+	_ = newFile().Add(c, "ctl", user, group, 0666, &ctlOps{a: a, chatID: chatID, dir: c})
+	a.chatDirsMu.Lock()
+	a.chatDirs[chatID] = c
+	a.chatDirsMu.Unlock()
+	return c
+}
+
+// addOutFiles adds the "out" file to a chat (or topic) directory, along with
+// "out.json", which has the same messages in JSON format, one per line.
+func (a *account) addOutFiles(dir *srv.File, chatID int64) {
+	_ = newFile().Add(dir, "out", user, group, 0444, newOutOps(a, chatID, newOutStream(), defaultReplay))
+	_ = newFile().Add(dir, "out.json", user, group, 0444, newOutOps(a, chatID, newOutStream(), defaultReplay))
+}
+
+// addMessage assumes chat is a chat (or topic) directory.
+func (a *account) addMessage(chat *srv.File, m *tgMessage) {
 	f := new(srv.File)
 	formatted := getFormattedText(m)
 	if chat != nil {
-		out := chat.Find("out")
-		ops := out.Ops.(*outOps)
-		ops.mu.Lock()
-		ops.buf = append(ops.buf, getTextWithAuthor(m)...)
-		ops.mtime = uint32(time.Now().Unix())
-		ops.cond.Broadcast()
-		ops.mu.Unlock()
+		r := nodes.Record{
+			Data: getTextWithAuthor(m),
+			Time: m.When,
+		}
+		if !m.IsOutgoing {
+			// So that it can be marked read when delivered.
+			r.Key = m.ID
+		}
+		chat.Find("out").Ops.(*outOps).Stream.Append(r)
+		r.Data = getJSON(m)
+		chat.Find("out.json").Ops.(*outOps).Stream.Append(r)
 	}
 	msgNode := &messageOps{
+		a:          a,
 		chatID:     m.ChatID,
 		messageID:  m.ID,
+		when:       m.When.Unix(),
 		isOutgoing: m.IsOutgoing,
 		contents:   nodes.NewRAMFile(formatted),
+		json:       &messageJSONOps{TextFile: nodes.NewTextFile(getJSON(m))},
+	}
+	a.msgNodesMu.Lock()
+	a.msgNodes[m.ID] = msgNode
+	a.indexMessage(msgNode)
+	a.msgNodesMu.Unlock()
+	msgNode.file = f
+	// The directory containing the message files.
+	parent := chat
+	var layout *dateLayout
+	if config.Layout == "date" && chat != nil {
+		layout = a.getLayout(chat)
+		parent = layout.dayDir(m.When)
+	}
+	first := true
+	if parent != nil {
+		a.msgNodesMu.Lock()
+		var demoted int64
+		first, demoted = a.seconds.add(secondKey{dir: parent, unix: m.When.Unix()}, m.ID)
+		demotedNode := a.msgNodes[demoted]
+		a.msgNodesMu.Unlock()
+		if demotedNode != nil {
+			a.renameMessage(demotedNode, false)
+		}
 	}
-	msgNodes[m.ID] = msgNode
-	_ = f.Add(chat, fmt.Sprintf("%d.txt", m.When.Unix()), user, group, 0666, msgNode)
+	base := messageBaseName(m.When.Unix(), m.ID, first)
+	_ = f.Add(parent, base+".txt", user, group, 0666, msgNode)
+	jf := newFile()
+	_ = jf.Add(parent, base+".json", user, group, 0444, msgNode.json)
 	// These metadata changes need to happen after (*srv.File).Add, lest they be
 	// overwritten.
 	f.Mtime = uint32(m.When.Unix())
 	f.Atime = f.Mtime
+	jf.Mtime = f.Mtime
+	jf.Atime = f.Mtime
+	if config.MessageNames == "unix-id" && parent != nil && first {
+		addAlias(parent, fmt.Sprintf("%d.txt", m.When.Unix()), f)
+		addAlias(parent, fmt.Sprintf("%d.json", m.When.Unix()), jf)
+	}
+	if layout != nil {
+		layout.addMessage(m, f, jf)
+	}
+	if m.IsPinned {
+		a.markPinned(m.ChatID, m.ID, true)
+		a.refreshPinned(m.ChatID)
+	}
 	if chat != nil {
 		if chat.Mtime < f.Mtime {
 			chat.Mtime = f.Mtime
@@ -714,6 +951,49 @@ func addMessage(chat *srv.File, m *tgMessage) {
 	}
 }
 
+// removeMessage removes a message from the database and its files from the
+// file system, along with their aliases and copies.
+func (a *account) removeMessage(messageID int64) {
+	if err := a.deleteMessage(messageID); err != nil {
+		log.Printf("Could not delete message %d: %v", messageID, err)
+	}
+	a.msgNodesMu.Lock()
+	m := a.msgNodes[messageID]
+	delete(a.msgNodes, messageID)
+	if m != nil {
+		a.unindexMessage(m)
+	}
+	a.msgNodesMu.Unlock()
+	if m == nil {
+		return
+	}
+	key := secondKey{dir: m.file.Parent, unix: m.when}
+	if jf := m.file.Parent.Find(strings.TrimSuffix(m.file.Name, ".txt") + ".json"); jf != nil {
+		removeAliases(jf)
+		jf.Remove()
+	}
+	removeAliases(m.file)
+	a.removeMessageCopies(m)
+	m.file.Remove()
+	a.msgNodesMu.Lock()
+	promoted := a.msgNodes[a.seconds.remove(key, messageID)]
+	a.msgNodesMu.Unlock()
+	if promoted != nil {
+		a.renameMessage(promoted, true)
+	}
+	if a.pinnedIDs[m.chatID][messageID] {
+		a.markPinned(m.chatID, messageID, false)
+		a.refreshPinned(m.chatID)
+	}
+}
+
+// toHandle converts a name to something usable as a file name.
+func toHandle(name string) string {
+	handle := strings.ToLower(strings.TrimSpace(name))
+	handle = strings.Replace(handle, " ", "-", -1)
+	return strings.Replace(handle, "/", "-", -1)
+}
+
 func id2key(id int64) []byte {
 	return []byte(fmt.Sprintf("%d", id))
 }
@@ -723,6 +1003,21 @@ func key2id(key []byte) int64 {
 	return id
 }
 
+// newOutStream creates a stream for the messages of a chat (or topic).
+func newOutStream() *nodes.Stream {
+	capacity := config.OutBuffer
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return nodes.NewStream(capacity)
+}
+
+// outTimeout returns how long reads of "out" and similar files block before
+// returning no data, zero meaning forever.
+func outTimeout() time.Duration {
+	return time.Duration(config.OutTimeout) * time.Second
+}
+
 // Placeholder/extension point.
 func newFile() *srv.File {
 	return &srv.File{}
@@ -5,7 +5,7 @@ import (
 )
 
 // A basic representation of a message. Telegram messages are much richer.
-// We save these to our local database.
+// We save these to our local database, and serve them in JSON format too.
 type tgMessage struct {
 	ID         int64
 	ChatID     int64
@@ -14,4 +14,8 @@ type tgMessage struct {
 	QuotedText string
 	Text       string
 	IsOutgoing bool
+	ThreadID   int64 // Forum topic, zero if not a topic message.
+	ReplyToID  int64 // Message replied to, zero if not a reply.
+	IsPinned   bool  `json:",omitempty"`
+	TTL        int64 `json:",omitempty"` // Self-destruct timer in seconds, zero if none.
 }
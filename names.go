@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Message files are named after the unix timestamp of the message. When a
+// directory has several messages from the same second, the one with the
+// smallest id is named after the timestamp alone, and the others also have
+// their id in the name. This way, names don't depend on the order in which
+// messages are added, e.g., when loading the history.
+
+// secondKey identifies the messages of a directory from the same second.
+type secondKey struct {
+	dir  *srv.File
+	unix int64
+}
+
+// messageSeconds has the ids of the messages of each directory and second.
+type messageSeconds map[secondKey]sortedIDs
+
+// add adds a message id. It tells whether it's now the smallest one, and if
+// so, returns the id that was the smallest before, if any.
+func (s messageSeconds) add(key secondKey, id int64) (first bool, demoted int64) {
+	ids, i := s[key].add(id)
+	s[key] = ids
+	if i != 0 {
+		return false, 0
+	}
+	if len(ids) > 1 {
+		demoted = ids[1]
+	}
+	return true, demoted
+}
+
+// remove removes a message id. If it was the smallest one, it returns the id
+// that is now the smallest, if any.
+func (s messageSeconds) remove(key secondKey, id int64) (promoted int64) {
+	ids, i := s[key].remove(id)
+	if i < 0 {
+		return 0
+	}
+	if len(ids) == 0 {
+		delete(s, key)
+		return 0
+	}
+	s[key] = ids
+	if i == 0 {
+		return ids[0]
+	}
+	return 0
+}
+
+// first returns the smallest message id, or zero if there are none.
+func (s messageSeconds) first(key secondKey) int64 {
+	if ids := s[key]; len(ids) > 0 {
+		return ids[0]
+	}
+	return 0
+}
+
+// messageBaseName returns the name of the files for a message, without
+// extension. It's the unix timestamp of the message if it's the first message
+// of its second (see messageSeconds), unless the configuration requires unique
+// names. Otherwise, the message id is appended.
+func messageBaseName(unix int64, id int64, first bool) string {
+	if first && config.MessageNames != "unix-id" {
+		return fmt.Sprintf("%d", unix)
+	}
+	return fmt.Sprintf("%d-%d", unix, id)
+}
+
+// renameMessage renames the files of a message, and their copies, once it
+// becomes or stops being the first message of its second. If the
+// configuration requires unique names, only the aliases named after the
+// timestamp change.
+func (a *account) renameMessage(m *messageOps, first bool) {
+	dir := m.file.Parent
+	jf := dir.Find(strings.TrimSuffix(m.file.Name, ".txt") + ".json")
+	if config.MessageNames == "unix-id" {
+		removeAliases(m.file)
+		if jf != nil {
+			removeAliases(jf)
+		}
+		if first {
+			addAlias(dir, fmt.Sprintf("%d.txt", m.when), m.file)
+			if jf != nil {
+				addAlias(dir, fmt.Sprintf("%d.json", m.when), jf)
+			}
+		}
+		return
+	}
+	base := messageBaseName(m.when, m.messageID, first)
+	_ = m.file.Rename(base + ".txt")
+	if jf != nil {
+		_ = jf.Rename(base + ".json")
+	}
+	for _, l := range a.layouts {
+		l.renameCopies(m, base)
+	}
+}
+
+// renameCopies renames the copies of the files of a message in the "latest"
+// and "today" directories.
+func (l *dateLayout) renameCopies(m *messageOps, base string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, copies := range [][]*messageCopies{l.latestFiles, l.todayFiles} {
+		for _, c := range copies {
+			if len(c.files) == 0 {
+				continue
+			}
+			if mc, ok := c.files[0].Ops.(messageCopyOps); !ok || mc.messageOps != m {
+				continue
+			}
+			for _, f := range c.files {
+				_ = f.Rename(base + path.Ext(f.Name))
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestMessageBaseName(t *testing.T) {
+	for _, c := range []struct {
+		names string
+		first bool
+		want  string
+	}{
+		{"", true, "1600000000"},
+		{"", false, "1600000000-123"},
+		{"unix-id", true, "1600000000-123"},
+		{"unix-id", false, "1600000000-123"},
+	} {
+		config = &tgConfig{MessageNames: c.names}
+		if got := messageBaseName(1600000000, 123, c.first); got != c.want {
+			t.Errorf("%q, first=%v: got %q, want %q", c.names, c.first, got, c.want)
+		}
+	}
+}
+
+func TestMessageSecondsOrder(t *testing.T) {
+	key := secondKey{unix: 1600000000}
+	for _, order := range [][]int64{
+		{1, 2, 3},
+		{3, 2, 1},
+		{2, 3, 1},
+	} {
+		s := make(messageSeconds)
+		// The message that is first of its second, as the messages are added.
+		var first int64
+		for _, id := range order {
+			isFirst, demoted := s.add(key, id)
+			if isFirst {
+				if demoted != first {
+					t.Errorf("%v: adding %d demoted %d, want %d", order, id, demoted, first)
+				}
+				first = id
+			} else if demoted != 0 {
+				t.Errorf("%v: adding %d demoted %d, want none", order, id, demoted)
+			}
+		}
+		if first != 1 {
+			t.Errorf("%v: got %d first, want 1", order, first)
+		}
+	}
+}
+
+func TestMessageSecondsRemove(t *testing.T) {
+	key := secondKey{unix: 1600000000}
+	s := make(messageSeconds)
+	for _, id := range []int64{1, 2, 3} {
+		s.add(key, id)
+	}
+	if got := s.remove(key, 2); got != 0 {
+		t.Errorf("removing 2 promoted %d, want none", got)
+	}
+	if got := s.remove(key, 1); got != 3 {
+		t.Errorf("removing 1 promoted %d, want 3", got)
+	}
+	if got := s.remove(key, 3); got != 0 {
+		t.Errorf("removing 3 promoted %d, want none", got)
+	}
+	if len(s) != 0 {
+		t.Errorf("got %v, want no seconds left", s)
+	}
+}
+
+func TestRenameMessage(t *testing.T) {
+	config = &tgConfig{}
+	a := &account{layouts: make(map[*srv.File]*dateLayout)}
+	dir := newFile()
+	_ = dir.Add(nil, "chat", user, group, p.DMDIR|0777, nil)
+	m := &messageOps{messageID: 123, when: 1600000000, file: newFile()}
+	_ = m.file.Add(dir, "1600000000.txt", user, group, 0666, m)
+	_ = newFile().Add(dir, "1600000000.json", user, group, 0444, nil)
+
+	a.renameMessage(m, false)
+	for _, name := range []string{"1600000000-123.txt", "1600000000-123.json"} {
+		if dir.Find(name) == nil {
+			t.Errorf("%q not found after demoting", name)
+		}
+	}
+	a.renameMessage(m, true)
+	for _, name := range []string{"1600000000.txt", "1600000000.json"} {
+		if dir.Find(name) == nil {
+			t.Errorf("%q not found after promoting", name)
+		}
+	}
+}
+
+func TestRenumberMessageNames(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	config = &tgConfig{}
+	// A message we sent, with a temporary id, and then one we got in the
+	// same second, with a smaller id.
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 1048577, "chat_id": 42, "is_outgoing": true, "date": 1600000000, "content": {"text": {"text": "mine"}}}}`))
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 1000, "chat_id": 42, "date": 1600000000, "content": {"text": {"text": "theirs"}}}}`))
+	// Its final id is smaller still.
+	a.handleUpdateMessageSendSucceeded(mustDocument(t, `{"old_message_id": 1048577, "message": {"id": 500, "chat_id": 42}}`))
+	c := a.findChat(42)
+	for name, id := range map[string]int64{
+		"1600000000.txt":      500,
+		"1600000000-1000.txt": 1000,
+	} {
+		f := c.Find(name)
+		if f == nil {
+			t.Errorf("%q not found", name)
+		} else if got := f.Ops.(*messageOps).messageID; got != id {
+			t.Errorf("%q: got message %d, want %d", name, got, id)
+		}
+	}
+
+	// Once the message is deleted, the other one takes the timestamp name,
+	// and a new message from the same second doesn't.
+	a.removeMessage(500)
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 2000, "chat_id": 42, "date": 1600000000, "content": {"text": {"text": "more"}}}}`))
+	for name, id := range map[string]int64{
+		"1600000000.txt":      1000,
+		"1600000000-2000.txt": 2000,
+	} {
+		f := c.Find(name)
+		if f == nil {
+			t.Errorf("%q not found", name)
+		} else if got := f.Ops.(*messageOps).messageID; got != id {
+			t.Errorf("%q: got message %d, want %d", name, got, id)
+		}
+	}
+}
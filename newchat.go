@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	bolt "go.etcd.io/bbolt"
+)
+
+// rootOps is the file system node for the root directory of an account.
+// Creating a directory in it starts a private chat (see Create).
+type rootOps struct {
+	a *account
+}
+
+// Lookup implements nodes.FLookupOp, to find chat directories by the names
+// they were created with (see Create).
+func (rootOps) Lookup(dir *srv.File, name string) *srv.File {
+	return lookupAlias(dir, name)
+}
+
+// Create implements srv.FCreateOp. Only directories can be created, and their
+// name must be the handle or the username of a user, or a name that Telegram
+// can find among the contacts. Creating a directory starts a private chat with
+// the user. The chat directory is named like the others (after the user's
+// handle), but can also be reached with the name it was created with, until
+// restarting.
+func (r rootOps) Create(fid *srv.FFid, name string, perm uint32) (*srv.File, error) {
+	if perm&p.DMDIR == 0 {
+		return nil, errors.New("only chat directories can be created")
+	}
+	userID, err := r.a.resolveUser(name)
+	if err != nil {
+		return nil, err
+	}
+	// The chat directory is added by the goroutine handling Telegram events,
+	// which may also be adding it, e.g., for a message in the new chat.
+	var c *srv.File
+	_, err = r.a.queryHandle(genericMap{
+		"@type":   "createPrivateChat",
+		"user_id": userID,
+		"force":   false,
+	}, func(chat Document) error {
+		chatID, _ := chat.GetInt64("id")
+		var handle []byte
+		err := r.a.database.Update(func(tx *bolt.Tx) error {
+			handle = getHandle(tx.Bucket(usersBucket), userID)
+			if handle == nil {
+				return fmt.Errorf("could not find handle of user %d", userID)
+			}
+			return tx.Bucket(chatsBucket).Put(handle, id2key(chatID))
+		})
+		if err != nil {
+			return err
+		}
+		c = r.a.findChat(chatID)
+		if c == nil {
+			c = r.a.addChat(string(handle), chatID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Name != name {
+		addAlias(fid.F, name, c)
+	}
+	return c, nil
+}
+
+// resolveUser finds the id of a user by handle or username, first among the
+// users we know about, then among the contacts, and finally among public
+// usernames. Only exact matches count, although contacts are searched by
+// prefixes of names.
+func (a *account) resolveUser(name string) (int64, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "@"))
+	var userID int64
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		return users.ForEach(func(k, _ []byte) error {
+			if u := getUser(users, key2id(k)); userNamed(u, name) {
+				userID = u.ID
+			}
+			return nil
+		})
+	})
+	if userID != 0 {
+		return userID, nil
+	}
+	contacts, err := a.query(genericMap{
+		"@type": "searchContacts",
+		"query": name,
+		"limit": 20,
+	})
+	if err != nil {
+		return 0, err
+	}
+	ids, _ := contacts.GetInt64s("user_ids")
+	if userID = a.findUserNamed(ids, name); userID != 0 {
+		return userID, nil
+	}
+	chat, err := a.query(genericMap{
+		"@type":    "searchPublicChat",
+		"username": name,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not find user %q: %v", name, err)
+	}
+	if kind, _ := chat.GetString("type.@type"); kind != "chatTypePrivate" {
+		return 0, fmt.Errorf("%q is not a user", name)
+	}
+	userID, _ = chat.GetInt64("type.user_id")
+	return userID, nil
+}
+
+// userNamed tells whether a user has the given handle or username, which must
+// be in lower case.
+func userNamed(u *tgUser, name string) bool {
+	return u != nil && (u.Handle == name || strings.ToLower(u.Username) == name)
+}
+
+// findUserNamed returns the id of the user with the given handle or username
+// (see userNamed) among the given users, or zero if there is none. Telegram
+// tells about users before giving their ids, so we know about them.
+func (a *account) findUserNamed(userIDs []int64, name string) int64 {
+	var userID int64
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		for _, id := range userIDs {
+			if u := getUser(users, id); userNamed(u, name) {
+				userID = u.ID
+				return nil
+			}
+		}
+		return nil
+	})
+	return userID
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestFindUserNamed(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		for _, u := range []*tgUser{
+			{ID: 1, Handle: "bobby-tables", Username: "Bobby"},
+			{ID: 2, Handle: "bob", Username: "bob_smith"},
+			{ID: 3, Handle: "robert", Username: "Bob"},
+		} {
+			if err := putUser(users, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ids  []int64
+		name string
+		want int64
+	}{
+		{[]int64{1, 2}, "bob", 2},
+		{[]int64{1, 3}, "bob", 3},
+		{[]int64{1}, "bob", 0},
+		{[]int64{1, 4}, "bobby-tables", 1},
+		{nil, "bob", 0},
+	} {
+		if got := a.findUserNamed(c.ids, c.name); got != c.want {
+			t.Errorf("%v, %q: got %d, want %d", c.ids, c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// outboxEntry is an outgoing message. It is kept in the outbox bucket from
+// when it is written until Telegram reports it sent, so that it is not lost
+// if we are offline or not yet authorized, or if we are restarted meanwhile.
+type outboxEntry struct {
+	ID        uint64 // The key in the outbox bucket.
+	ChatID    int64
+	ThreadID  int64 `json:",omitempty"`
+	ReplyToID int64 `json:",omitempty"`
+	Text      string
+	Created   time.Time
+
+	// The unix time at which Telegram should send the message, if scheduled.
+	SendAt int64 `json:",omitempty"`
+
+	// The temporary message id given by Telegram when it accepts the message
+	// for sending, zero until then.
+	MessageID int64 `json:",omitempty"`
+
+	Failed bool   `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// sendText queues a text message for sending, as described by e, whose ID and
+// creation time are set here. The message is given to tdlib right away if
+// possible, otherwise when tdlib is ready. It fails if we are not logged in.
+func (a *account) sendText(e outboxEntry) error {
+	if err := a.checkAuthorized(); err != nil {
+		return err
+	}
+	e.Created = time.Now()
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+		return putOutboxEntry(bucket, &e)
+	})
+	if err != nil {
+		return err
+	}
+	a.refreshPending(e.ChatID)
+	if a.ready() {
+		a.trySend(&e)
+	}
+	return nil
+}
+
+func (a *account) ready() bool {
+	a.outboxMu.Lock()
+	defer a.outboxMu.Unlock()
+	return a.connected && a.authorized
+}
+
+// trySend gives an outbox entry to tdlib, unless it was already given and we
+// are still waiting for the response.
+func (a *account) trySend(e *outboxEntry) {
+	a.outboxMu.Lock()
+	defer a.outboxMu.Unlock()
+	if a.inflight[e.ID] != "" {
+		return
+	}
+	query := genericMap{
+		"@type":   "sendMessage",
+		"chat_id": e.ChatID,
+		"input_message_content": genericMap{
+			"@type": "inputMessageText",
+			"text": genericMap{
+				"text": e.Text,
+			},
+			// To send formatted code and other things, I'd need to send an entities property,
+			// containing offsets, lengths, and types of the entities. See:
+			// https://core.telegram.org/tdlib/docs/classtd_1_1td__api_1_1formatted_text.html
+		},
+	}
+	if e.ThreadID != 0 {
+		query["message_thread_id"] = e.ThreadID
+	}
+	if e.ReplyToID != 0 {
+		query["reply_to_message_id"] = e.ReplyToID
+	}
+	if e.SendAt != 0 {
+		query["options"] = genericMap{
+			"@type": "messageSendOptions",
+			"scheduling_state": genericMap{
+				"@type":     "messageSchedulingStateSendAtDate",
+				"send_date": e.SendAt,
+			},
+		}
+	}
+	id := e.ID
+	a.inflight[id] = a.sendCallback(query, func(doc Document) {
+		a.handleSendResponse(id, doc)
+	})
+}
+
+// handleSendResponse records the temporary message id of an outbox entry
+// accepted by tdlib, or marks the entry failed.
+func (a *account) handleSendResponse(id uint64, doc Document) {
+	extra, _ := doc.GetString("@extra")
+	a.outboxMu.Lock()
+	// Unless the entry was given to tdlib again meanwhile (see clearInflight).
+	if a.inflight[id] == extra {
+		delete(a.inflight, id)
+	}
+	a.outboxMu.Unlock()
+	sendErr := responseError(doc)
+	messageID, _ := doc.GetInt64("id")
+	e, err := a.updateOutboxEntry(func(e *outboxEntry) bool {
+		return e.ID == id
+	}, func(e *outboxEntry) {
+		if sendErr != nil {
+			e.Failed = true
+			e.Error = sendErr.Error()
+		} else {
+			e.MessageID = messageID
+		}
+	})
+	if err != nil {
+		log.Printf("Could not update outbox entry %d: %v", id, err)
+	}
+	if e != nil {
+		a.refreshPending(e.ChatID)
+	}
+}
+
+// retryOutbox sends the outbox entries not yet accepted by tdlib.
+func (a *account) retryOutbox() {
+	var pending []*outboxEntry
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		var err error
+		pending, err = outboxEntries(tx, func(e *outboxEntry) bool {
+			return e.MessageID == 0 && !e.Failed
+		})
+		return err
+	})
+	for _, e := range pending {
+		a.trySend(e)
+	}
+}
+
+// clearInflight forgets the outbox entries given to tdlib whose response we
+// are waiting for, and the callbacks for the responses. The caller must hold
+// a.outboxMu.
+func (a *account) clearInflight() {
+	for id, extra := range a.inflight {
+		removeCallback(extra)
+		delete(a.inflight, id)
+	}
+}
+
+// resetOutbox forgets the temporary message ids of the outbox entries not yet
+// sent, so that they are given to tdlib again. This is needed when tdlib lost
+// them, i.e., after logging out (see recreateClient).
+func (a *account) resetOutbox() {
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		accepted, err := outboxEntries(tx, func(e *outboxEntry) bool {
+			return e.MessageID != 0 && !e.Failed
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range accepted {
+			e.MessageID = 0
+			if err := putOutboxEntry(tx.Bucket(outboxBucket), e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not reset outbox: %v", err)
+	}
+}
+
+// setReadiness updates what we know about the connection and authorization
+// state of tdlib, and the "status" files, and sends queued messages if tdlib
+// has become ready. Outbox entries given to tdlib before, whose response never
+// came, e.g., because of a disconnection, are given to it again.
+func (a *account) setReadiness(update func()) {
+	a.outboxMu.Lock()
+	wasReady := a.connected && a.authorized
+	update()
+	isReady := a.connected && a.authorized
+	if isReady && !wasReady {
+		a.clearInflight()
+	}
+	a.outboxMu.Unlock()
+	a.refreshStatus()
+	if isReady && !wasReady {
+		a.retryOutbox()
+	}
+}
+
+func (a *account) handleUpdateConnectionState(doc Document) {
+	state, _ := doc.GetString("state.@type")
+	a.setReadiness(func() {
+		a.connected = state == "connectionStateReady"
+		a.connection = kebabName(strings.TrimPrefix(state, "connectionState"))
+	})
+}
+
+// The message send succeeded updates are used to remove sent messages from
+// the outbox, and to replace the temporary ids of their messages with the
+// final ones. Temporary ids are unique only within a chat.
+func (a *account) handleUpdateMessageSendSucceeded(doc Document) {
+	oldID, _ := doc.GetInt64("old_message_id")
+	newID, _ := doc.GetInt64("message.id")
+	chatID, _ := doc.GetInt64("message.chat_id")
+	var sent []*outboxEntry
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		var err error
+		sent, err = outboxEntries(tx, func(e *outboxEntry) bool {
+			return e.ChatID == chatID && e.MessageID == oldID
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range sent {
+			if err := tx.Bucket(outboxBucket).Delete(id2key(int64(e.ID))); err != nil {
+				return err
+			}
+		}
+		return a.renumberMessage(tx, oldID, newID)
+	})
+	if err != nil {
+		log.Printf("Could not handle message send success: %v", err)
+	}
+	if _, scheduled := doc.GetString("message.scheduling_state.@type"); scheduled {
+		a.removeScheduled(oldID)
+		a.addScheduled(doc)
+	}
+	if len(sent) != 0 {
+		a.refreshPending(chatID)
+	}
+}
+
+func (a *account) handleUpdateMessageSendFailed(doc Document) {
+	oldID, _ := doc.GetInt64("old_message_id")
+	chatID, _ := doc.GetInt64("message.chat_id")
+	message, ok := doc.GetString("error_message")
+	if !ok {
+		// Newer tdlib versions.
+		message, _ = doc.GetString("error.message")
+	}
+	e, err := a.updateOutboxEntry(func(e *outboxEntry) bool {
+		return e.ChatID == chatID && e.MessageID == oldID
+	}, func(e *outboxEntry) {
+		e.Failed = true
+		e.Error = message
+	})
+	if err != nil {
+		log.Printf("Could not handle message send failure: %v", err)
+	}
+	a.removeScheduled(oldID)
+	if e != nil {
+		a.refreshPending(e.ChatID)
+	}
+}
+
+// renumberMessage replaces the temporary id of a sent message with its final
+// id, in the database and in the file system. Its files, and those of the other
+// messages from the same second, are renamed if the message with the smallest
+// id changes (see names.go). Otherwise, their names are left alone.
+func (a *account) renumberMessage(tx *bolt.Tx, oldID int64, newID int64) error {
+	bucket := tx.Bucket(messagesBucket)
+	value := bucket.Get(id2key(oldID))
+	if value == nil {
+		return nil
+	}
+	var m tgMessage
+	if err := json.Unmarshal(value, &m); err != nil {
+		return err
+	}
+	unindexMessage(tx, &m)
+	if err := bucket.Delete(id2key(oldID)); err != nil {
+		return err
+	}
+	m.ID = newID
+	if err := indexMessage(tx, &m); err != nil {
+		return err
+	}
+	value, _ = json.Marshal(&m)
+	if err := bucket.Put(id2key(newID), value); err != nil {
+		return err
+	}
+	a.msgNodesMu.Lock()
+	ops := a.msgNodes[oldID]
+	var wasFirst, isFirst int64
+	var demoted, promoted *messageOps
+	if ops != nil {
+		a.unindexMessage(ops)
+		delete(a.msgNodes, oldID)
+		key := secondKey{dir: ops.file.Parent, unix: ops.when}
+		if key.dir != nil {
+			wasFirst = a.seconds.first(key)
+			a.seconds.remove(key, oldID)
+		}
+		ops.messageID = newID
+		a.msgNodes[newID] = ops
+		a.indexMessage(ops)
+		if key.dir != nil {
+			a.seconds.add(key, newID)
+			isFirst = a.seconds.first(key)
+		}
+		if wasFirst != isFirst {
+			demoted = a.msgNodes[wasFirst]
+			promoted = a.msgNodes[isFirst]
+		}
+	}
+	a.msgNodesMu.Unlock()
+	if ops == nil {
+		return nil
+	}
+	ops.json.Set(getJSON(&m))
+	if isFirst == 0 {
+		// Not in a directory.
+		return nil
+	}
+	// Names are given up before being taken, lest they collide.
+	if demoted != nil && demoted != ops {
+		a.renameMessage(demoted, false)
+	}
+	if isFirst != newID {
+		a.renameMessage(ops, false)
+	}
+	if promoted != nil && promoted != ops {
+		a.renameMessage(promoted, true)
+	}
+	if isFirst == newID && wasFirst != oldID {
+		a.renameMessage(ops, true)
+	}
+	return nil
+}
+
+// retryFailed queues the failed messages of a chat for sending again.
+func (a *account) retryFailed(chatID int64) error {
+	var retried []*outboxEntry
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		var err error
+		retried, err = outboxEntries(tx, func(e *outboxEntry) bool {
+			return e.ChatID == chatID && e.Failed
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range retried {
+			e.Failed = false
+			e.Error = ""
+			e.MessageID = 0
+			if err := putOutboxEntry(tx.Bucket(outboxBucket), e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.refreshPending(chatID)
+	if a.ready() {
+		for _, e := range retried {
+			a.trySend(e)
+		}
+	}
+	return nil
+}
+
+// discardFailed removes the failed messages of a chat from the outbox.
+func (a *account) discardFailed(chatID int64) error {
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		failed, err := outboxEntries(tx, func(e *outboxEntry) bool {
+			return e.ChatID == chatID && e.Failed
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range failed {
+			if err := tx.Bucket(outboxBucket).Delete(id2key(int64(e.ID))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.refreshPending(chatID)
+	return nil
+}
+
+// refreshPending updates the "pending" file of the given chat, which lists
+// the messages not yet sent, one per line, as the outbox entry id, the status
+// ("pending" or "failed"), and the text with newlines replaced by spaces,
+// separated by tabs. Failed messages have the error as an additional field.
+func (a *account) refreshPending(chatID int64) {
+	c := a.findChat(chatID)
+	if c == nil {
+		return
+	}
+	var b bytes.Buffer
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		return forEachOutboxEntry(tx, func(e *outboxEntry) error {
+			if e.ChatID != chatID {
+				return nil
+			}
+			status := "pending"
+			if e.Failed {
+				status = "failed"
+			}
+			fmt.Fprintf(&b, "%d\t%s\t%s", e.ID, status, strings.Replace(strings.TrimSpace(e.Text), "\n", " ", -1))
+			if e.Failed {
+				fmt.Fprintf(&b, "\t%s", e.Error)
+			}
+			b.WriteByte('\n')
+			return nil
+		})
+	})
+	c.Ops.(*chatOps).pending.Set(b.Bytes())
+}
+
+// refreshAllPending updates the "pending" files of all chats with messages in
+// the outbox.
+func (a *account) refreshAllPending() {
+	chatIDs := make(map[int64]bool)
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		return forEachOutboxEntry(tx, func(e *outboxEntry) error {
+			chatIDs[e.ChatID] = true
+			return nil
+		})
+	})
+	for chatID := range chatIDs {
+		a.refreshPending(chatID)
+	}
+}
+
+func putOutboxEntry(bucket *bolt.Bucket, e *outboxEntry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(id2key(int64(e.ID)), value)
+}
+
+func forEachOutboxEntry(tx *bolt.Tx, fn func(e *outboxEntry) error) error {
+	return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+		var e outboxEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		return fn(&e)
+	})
+}
+
+// outboxEntries returns the outbox entries that match.
+func outboxEntries(tx *bolt.Tx, match func(e *outboxEntry) bool) ([]*outboxEntry, error) {
+	var entries []*outboxEntry
+	err := forEachOutboxEntry(tx, func(e *outboxEntry) error {
+		if match(e) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// updateOutboxEntry applies change to the first outbox entry that matches,
+// and returns the updated entry, or nil if none matches.
+func (a *account) updateOutboxEntry(match func(e *outboxEntry) bool, change func(e *outboxEntry)) (*outboxEntry, error) {
+	var found *outboxEntry
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		entries, err := outboxEntries(tx, match)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		found = entries[0]
+		change(found)
+		return putOutboxEntry(tx.Bucket(outboxBucket), found)
+	})
+	return found, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestAccount returns an account with an empty database and an empty root
+// directory, but no tdlib client, so nothing must be sent to tdlib, and a
+// function to clean up.
+func newTestAccount(t *testing.T) (*account, func()) {
+	t.Helper()
+	if config == nil {
+		config = &tgConfig{}
+	}
+	dir, err := ioutil.TempDir("", "telegramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &account{
+		msgNodes:       make(map[int64]*messageOps),
+		seconds:        make(messageSeconds),
+		chatMessages:   make(map[int64]*chatMessageIDs),
+		chatDirs:       make(map[int64]*srv.File),
+		topicDirs:      make(map[topicKey]*srv.File),
+		layouts:        make(map[*srv.File]*dateLayout),
+		readStates:     make(map[int64]*readState),
+		rootUnread:     nodes.NewTextFile(nil),
+		events:         nodes.NewStream(100),
+		pinnedIDs:      make(map[int64]map[int64]bool),
+		secretStates:   make(map[int64]*nodes.TextFile),
+		scheduledFiles: make(map[int64]*srv.File),
+		inflight:       make(map[uint64]string),
+		statusFile:     nodes.NewTextFile(nil),
+		database:       mustSetupDatabase(filepath.Join(dir, "history.bolt")),
+	}
+	a.root = newFile()
+	_ = a.root.Add(nil, "root", user, group, p.DMDIR|0777, rootOps{a: a})
+	return a, func() {
+		_ = a.database.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func mustDocument(t *testing.T, s string) Document {
+	t.Helper()
+	doc, err := NewDocument(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestReadyClearsInflight(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	extra := "telegramfs-test"
+	queriesMu.Lock()
+	queries[extra] = queryCallback{a: a, callback: func(Document) {}}
+	queriesMu.Unlock()
+	a.inflight[1] = extra
+	a.setReadiness(func() {
+		a.connected = true
+		a.authorized = true
+	})
+	if len(a.inflight) != 0 {
+		t.Errorf("got in-flight entries %v, want none", a.inflight)
+	}
+	queriesMu.Lock()
+	_, kept := queries[extra]
+	queriesMu.Unlock()
+	if kept {
+		t.Error("callback for the response to the in-flight entry was kept")
+	}
+	if got := a.status(); got != "ready" {
+		t.Errorf("got status %q, want ready", got)
+	}
+}
+
+func TestStaleSendResponse(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	a.inflight[1] = "telegramfs-new"
+	a.handleSendResponse(1, mustDocument(t, `{"@type": "message", "id": 5, "@extra": "telegramfs-old"}`))
+	if got := a.inflight[1]; got != "telegramfs-new" {
+		t.Errorf("got in-flight query %q, want telegramfs-new", got)
+	}
+	a.handleSendResponse(1, mustDocument(t, `{"@type": "message", "id": 6, "@extra": "telegramfs-new"}`))
+	if len(a.inflight) != 0 {
+		t.Errorf("got in-flight entries %v, want none", a.inflight)
+	}
+}
+
+func TestCheckAuthorized(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	for _, c := range []struct {
+		connected  bool
+		authorized bool
+		ok         bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, true},
+		{true, true, true},
+	} {
+		a.setReadiness(func() {
+			a.connected = c.connected
+			a.authorized = c.authorized
+			a.authorization = "closed"
+			a.connection = "connecting"
+		})
+		if err := a.checkAuthorized(); (err == nil) != c.ok {
+			t.Errorf("connected=%v, authorized=%v: got error %v", c.connected, c.authorized, err)
+		}
+	}
+}
+
+func TestRemoveCallbacks(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	other := &account{}
+	queriesMu.Lock()
+	queries["telegramfs-a"] = queryCallback{a: a, callback: func(Document) {}}
+	queries["telegramfs-other"] = queryCallback{a: other, callback: func(Document) {}}
+	queriesMu.Unlock()
+	a.removeCallbacks()
+	queriesMu.Lock()
+	_, keptA := queries["telegramfs-a"]
+	_, keptOther := queries["telegramfs-other"]
+	delete(queries, "telegramfs-other")
+	queriesMu.Unlock()
+	if keptA || !keptOther {
+		t.Errorf("got callbacks kept %v (account) and %v (other account), want false and true", keptA, keptOther)
+	}
+}
+
+func TestSendEventsMatchChat(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		for _, e := range []*outboxEntry{
+			{ID: 1, ChatID: 10, MessageID: 1048577},
+			{ID: 2, ChatID: 20, MessageID: 1048577},
+			{ID: 3, ChatID: 30, MessageID: 1048577},
+		} {
+			if err := putOutboxEntry(tx.Bucket(outboxBucket), e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.handleUpdateMessageSendSucceeded(mustDocument(t, `{"old_message_id": 1048577, "message": {"id": 2097152, "chat_id": 20}}`))
+	a.handleUpdateMessageSendFailed(mustDocument(t, `{"old_message_id": 1048577, "message": {"chat_id": 30}, "error_message": "too long"}`))
+	got := make(map[uint64]bool)
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		return forEachOutboxEntry(tx, func(e *outboxEntry) error {
+			got[e.ID] = e.Failed
+			return nil
+		})
+	})
+	if want := map[uint64]bool{1: false, 3: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v (id to failed), want %v", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pinnedOps is the file system node for the "pinned" file of a chat, which
+// lists the pinned messages, one per line, as the paths of their files
+// relative to the chat directory, or as their ids if we don't have them.
+// Writing paths of message files to it, one per line, pins those messages.
+type pinnedOps struct {
+	*nodes.TextFile
+	a      *account
+	chatID int64
+	dir    *srv.File
+}
+
+// Wstat implements srv.FWstatOp, to allow opening with truncation.
+func (o *pinnedOps) Wstat(*srv.FFid, *p.Dir) error {
+	return nil
+}
+
+// Write implements srv.FWriteOp. Each write must contain whole lines.
+func (o *pinnedOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := o.a.pinMessageFile(o.chatID, o.dir, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// pinMessageFile pins the message whose file has the given path relative to
+// the chat directory.
+func (a *account) pinMessageFile(chatID int64, chat *srv.File, path string) error {
+	messageID, err := messageFileID(chat, path)
+	if err != nil {
+		return err
+	}
+	_, err = a.query(genericMap{
+		"@type":                "pinChatMessage",
+		"chat_id":              chatID,
+		"message_id":           messageID,
+		"disable_notification": false,
+		"only_for_self":        false,
+	})
+	return err
+}
+
+// markPinned records whether a message is pinned, without updating the
+// database or the file system.
+func (a *account) markPinned(chatID int64, messageID int64, pinned bool) {
+	ids := a.pinnedIDs[chatID]
+	if ids == nil {
+		ids = make(map[int64]bool)
+		a.pinnedIDs[chatID] = ids
+	}
+	if pinned {
+		ids[messageID] = true
+	} else {
+		delete(ids, messageID)
+	}
+}
+
+// setPinned records whether a message is pinned, in the database too, and
+// updates the files of the chat and the message.
+func (a *account) setPinned(chatID int64, messageID int64, pinned bool) {
+	a.markPinned(chatID, messageID, pinned)
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket)
+		v := bucket.Get(id2key(messageID))
+		if v == nil {
+			return nil
+		}
+		var m tgMessage
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		m.IsPinned = pinned
+		if ops := a.findMessage(messageID); ops != nil {
+			ops.json.Set(getJSON(&m))
+		}
+		v, _ = json.Marshal(&m)
+		return bucket.Put(id2key(messageID), v)
+	})
+	if err != nil {
+		log.Printf("Could not update pinned state of message %d: %v", messageID, err)
+	}
+	a.refreshPinned(chatID)
+}
+
+// refreshPinned updates the "pinned" file of a chat.
+func (a *account) refreshPinned(chatID int64) {
+	c := a.findChat(chatID)
+	if c == nil {
+		return
+	}
+	var ids []int64
+	for id := range a.pinnedIDs[chatID] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var b strings.Builder
+	for _, id := range ids {
+		if m := a.findMessage(id); m != nil {
+			b.WriteString(relativePath(m.file, c))
+		} else {
+			fmt.Fprintf(&b, "%d", id)
+		}
+		b.WriteByte('\n')
+	}
+	c.Ops.(*chatOps).pinned.Set([]byte(b.String()))
+}
+
+// handleUpdateMessageIsPinned handles the pinned state updates of newer tdlib
+// versions, which allow pinning many messages.
+func (a *account) handleUpdateMessageIsPinned(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	messageID, _ := doc.GetInt64("message_id")
+	pinned, _ := doc.GetBool("is_pinned")
+	a.setPinned(chatID, messageID, pinned)
+}
+
+// handleUpdateChatPinnedMessage handles the pinned state updates of older
+// tdlib versions, which allow pinning only one message.
+func (a *account) handleUpdateChatPinnedMessage(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	messageID, _ := doc.GetInt64("pinned_message_id")
+	for id := range a.pinnedIDs[chatID] {
+		if id != messageID {
+			a.setPinned(chatID, id, false)
+		}
+	}
+	if messageID != 0 {
+		a.setPinned(chatID, messageID, true)
+	}
+}
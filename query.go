@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// queryTimeout is how long query waits for a response.
+const queryTimeout = 30 * time.Second
+
+// Callbacks for responses to queries, keyed by the "@extra" field, which
+// tdlib copies from queries to their responses.
+var (
+	queriesMu  sync.Mutex
+	queries    = make(map[string]queryCallback)
+	queryCount uint64
+)
+
+// queryCallback is a callback for the response to a query sent by an account.
+type queryCallback struct {
+	a        *account
+	callback func(Document)
+}
+
+// sendCallback is like send, but arranges for callback to be called with the
+// response, from the goroutine handling the Telegram events of the account.
+// It returns the "@extra" field of the query (see removeCallback).
+func (a *account) sendCallback(query genericMap, callback func(Document)) string {
+	queriesMu.Lock()
+	queryCount++
+	extra := fmt.Sprintf("telegramfs-%d", queryCount)
+	queries[extra] = queryCallback{a: a, callback: callback}
+	queriesMu.Unlock()
+	query["@extra"] = extra
+	a.send(query)
+	return extra
+}
+
+// removeCallback forgets the callback for the response to the query with the
+// given "@extra" field, when no longer waiting for it.
+func removeCallback(extra string) {
+	queriesMu.Lock()
+	delete(queries, extra)
+	queriesMu.Unlock()
+}
+
+// removeCallbacks forgets the callbacks for the responses to the queries sent
+// by the account, which will never come after its client is closed.
+func (a *account) removeCallbacks() {
+	queriesMu.Lock()
+	defer queriesMu.Unlock()
+	for extra, q := range queries {
+		if q.a == a {
+			delete(queries, extra)
+		}
+	}
+}
+
+// query sends a query and waits for the response, which is returned as an
+// error if it is an error. It must not be called from the goroutine handling
+// the Telegram events of the account.
+func (a *account) query(query genericMap) (Document, error) {
+	return a.queryHandle(query, nil)
+}
+
+// queryHandle is like query, but unless the response is an error, it's also
+// given to handle, if not nil, from the goroutine handling the Telegram events
+// of the account. This is for changes to state only that goroutine may
+// change. The error returned by handle, if any, is returned.
+func (a *account) queryHandle(query genericMap, handle func(Document) error) (Document, error) {
+	type response struct {
+		doc Document
+		err error
+	}
+	c := make(chan response, 1)
+	extra := a.sendCallback(query, func(doc Document) {
+		err := responseError(doc)
+		if err == nil && handle != nil {
+			err = handle(doc)
+		}
+		c <- response{doc: doc, err: err}
+	})
+	select {
+	case r := <-c:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.doc, nil
+	case <-time.After(queryTimeout):
+		removeCallback(extra)
+		return nil, errors.New("timed out waiting for Telegram")
+	}
+}
+
+// responseError returns the error in a response, if the response is an error.
+func responseError(doc Document) error {
+	if kind, _ := doc.GetString("@type"); kind != "error" {
+		return nil
+	}
+	message, _ := doc.GetString("message")
+	code, _ := doc.GetInt64("code")
+	return fmt.Errorf("telegram error %d: %s", code, message)
+}
+
+// handleResponse calls the callback for a response, if there is one, and
+// tells whether there was.
+func handleResponse(doc Document) bool {
+	extra, ok := doc.GetString("@extra")
+	if !ok {
+		return false
+	}
+	queriesMu.Lock()
+	q, ok := queries[extra]
+	delete(queries, extra)
+	queriesMu.Unlock()
+	if !ok {
+		return false
+	}
+	q.callback(doc)
+	return true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// The layouts accepted by parseWhen for absolute times, interpreted in the
+// local time zone unless they include one.
+var whenLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// parseWhen parses the time at which to send a scheduled message. It can be
+// an absolute time (see whenLayouts), a unix timestamp, a duration from now
+// like "+1h30m", or a time of day like "09:00", optionally preceded or
+// followed by "today" or "tomorrow". A time of day alone means its next
+// occurrence.
+func parseWhen(spec string, now time.Time) (time.Time, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "+") {
+		d, err := time.ParseDuration(spec[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	if unix, err := strconv.ParseInt(spec, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	for _, layout := range whenLayouts {
+		if t, err := time.ParseInLocation(layout, spec, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	var clock, day string
+	for _, field := range strings.Fields(spec) {
+		switch field {
+		case "today", "tomorrow":
+			day = field
+		default:
+			if clock != "" {
+				return time.Time{}, fmt.Errorf("could not parse time %q", spec)
+			}
+			clock = field
+		}
+	}
+	var t time.Time
+	var err error
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err = time.Parse(layout, clock); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse time %q", spec)
+	}
+	when := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	if day == "tomorrow" || (day == "" && !when.After(now)) {
+		when = when.AddDate(0, 0, 1)
+	}
+	return when, nil
+}
+
+// scheduleHeader removes an "@at WHEN" first line from the text of a message,
+// and returns the time it specifies (see parseWhen), or the zero time if there
+// is no such line.
+func scheduleHeader(text string) (string, time.Time, error) {
+	if !strings.HasPrefix(text, "@at ") {
+		return text, time.Time{}, nil
+	}
+	header, rest := text, ""
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		header, rest = text[:i], text[i+1:]
+	}
+	when, err := parseWhen(strings.TrimPrefix(header, "@at "), time.Now())
+	if err != nil {
+		return text, time.Time{}, err
+	}
+	return rest, when, nil
+}
+
+// lookupInAt is used by lookup. It provides the "in.at" directory, where
+// walking to "in.at/WHEN" gives a file like "in", but whose messages are
+// scheduled to be sent at the given time (see parseWhen). Neither are listed in
+// directories.
+func lookupInAt(dir *srv.File, name string) *srv.File {
+	if name != "in.at" {
+		return nil
+	}
+	f := dir.Find("in")
+	if f == nil {
+		return nil
+	}
+	in, ok := f.Ops.(*inOps)
+	if !ok {
+		return nil
+	}
+	f = newFile()
+	nodes.AddHidden(f, dir, name, user, group, p.DMDIR|0777, &inAtOps{a: in.a, chatID: in.chatID, threadID: in.threadID})
+	return f
+}
+
+// inAtOps is the file system node for "in.at" directories (see lookupInAt).
+type inAtOps struct {
+	dirOps
+	a        *account
+	chatID   int64
+	threadID int64
+}
+
+// Lookup implements nodes.FLookupOp.
+func (o *inAtOps) Lookup(dir *srv.File, name string) *srv.File {
+	when, err := parseWhen(name, time.Now())
+	if err != nil {
+		return nil
+	}
+	in := newInOps(o.a, o.chatID, o.threadID)
+	in.sendAt = when
+	f := newFile()
+	nodes.AddHidden(f, dir, name, user, group, 0666, in)
+	return f
+}
+
+// scheduledOps is the file system node for a scheduled message. Its contents
+// are the message text.
+type scheduledOps struct {
+	*nodes.TextFile
+	a         *account
+	chatID    int64
+	messageID int64
+}
+
+// Remove implements srv.FRemoveOp. It cancels the message, and fails, keeping
+// the file, unless Telegram accepts. Removing a chat directory recursively
+// thus cancels its scheduled messages.
+func (s *scheduledOps) Remove(*srv.FFid) error {
+	return s.a.cancelScheduled(s.chatID, s.messageID)
+}
+
+// cancelScheduled cancels a scheduled message of a chat. It stays in
+// scheduledFiles until Telegram reports the message deleted, so that its
+// deletion isn't reported as an event (see handleUpdateDeleteMessages).
+func (a *account) cancelScheduled(chatID int64, messageID int64) error {
+	a.scheduledMu.Lock()
+	f := a.scheduledFiles[messageID]
+	a.scheduledMu.Unlock()
+	if f == nil || f.Ops.(*scheduledOps).chatID != chatID {
+		return fmt.Errorf("no scheduled message %d", messageID)
+	}
+	_, err := a.query(genericMap{
+		"@type":       "deleteMessages",
+		"chat_id":     chatID,
+		"message_ids": []int64{messageID},
+		"revoke":      true,
+	})
+	return err
+}
+
+// addScheduled adds a file for a scheduled message to the "scheduled"
+// directory of its chat. The file is named after the unix time at which the
+// message will be sent and its id, or is prefixed with "online" instead of a
+// time if the message will be sent when the peer comes online.
+func (a *account) addScheduled(doc Document) {
+	chatID, _ := doc.GetInt64("message.chat_id")
+	messageID, _ := doc.GetInt64("message.id")
+	sendDate, _ := doc.GetInt64("message.scheduling_state.send_date")
+	text, _ := doc.GetString("message.content.text.text")
+	chat := a.findChat(chatID)
+	if chat == nil {
+		return
+	}
+	dir := chat.Find("scheduled")
+	if dir == nil {
+		return
+	}
+	a.scheduledMu.Lock()
+	defer a.scheduledMu.Unlock()
+	if a.scheduledFiles[messageID] != nil {
+		return
+	}
+	name := fmt.Sprintf("%d-%d.txt", sendDate, messageID)
+	if sendDate == 0 {
+		name = fmt.Sprintf("online-%d.txt", messageID)
+	}
+	f := newFile()
+	ops := &scheduledOps{
+		TextFile:  nodes.NewTextFile([]byte(strings.TrimSpace(text) + "\n")),
+		a:         a,
+		chatID:    chatID,
+		messageID: messageID,
+	}
+	if err := f.Add(dir, name, user, group, 0444, ops); err != nil {
+		log.Printf("Could not add scheduled message %d: %v", messageID, err)
+		return
+	}
+	if sendDate != 0 {
+		f.Mtime = uint32(sendDate)
+		f.Atime = uint32(sendDate)
+	}
+	a.scheduledFiles[messageID] = f
+}
+
+// removeScheduled removes the file for a scheduled message, and tells whether
+// there was one.
+func (a *account) removeScheduled(messageID int64) bool {
+	a.scheduledMu.Lock()
+	f := a.scheduledFiles[messageID]
+	delete(a.scheduledFiles, messageID)
+	a.scheduledMu.Unlock()
+	if f == nil {
+		return false
+	}
+	f.Remove()
+	return true
+}
+
+// loadScheduled fetches the scheduled messages of a chat, which tdlib does not
+// send updates for at startup.
+func (a *account) loadScheduled(chatID int64) {
+	a.sendCallback(genericMap{
+		"@type":   "getChatScheduledMessages",
+		"chat_id": chatID,
+	}, func(doc Document) {
+		if err := responseError(doc); err != nil {
+			log.Printf("Could not get scheduled messages of chat %d: %v", chatID, err)
+			return
+		}
+		messages, _ := doc.GetDocuments("messages", "message")
+		for _, m := range messages {
+			a.addScheduled(m)
+		}
+	})
+}
+
+func (a *account) handleUpdateChatHasScheduledMessages(doc Document) {
+	if has, _ := doc.GetBool("has_scheduled_messages"); has {
+		chatID, _ := doc.GetInt64("chat_id")
+		a.loadScheduled(chatID)
+	}
+}
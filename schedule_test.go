@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestScheduleHeader(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		rest string
+		at   int64
+		ok   bool
+	}{
+		{"hello\n", "hello\n", 0, true},
+		{"@at 1600000000\nhello\n", "hello\n", 1600000000, true},
+		{"@at soon\nhello\n", "", 0, false},
+	} {
+		rest, when, err := scheduleHeader(c.text)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.text, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if rest != c.rest {
+			t.Errorf("%q: got text %q, want %q", c.text, rest, c.rest)
+		}
+		if got := when.Unix(); c.at != 0 && got != c.at {
+			t.Errorf("%q: got time %d, want %d", c.text, got, c.at)
+		}
+		if c.at == 0 && !when.IsZero() {
+			t.Errorf("%q: got time %v, want none", c.text, when)
+		}
+	}
+}
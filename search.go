@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The search index is an inverted index of message texts. Its keys are a word
+// and a message id separated by a NUL byte, so that all messages containing a
+// word can be found with a prefix scan. Its values are empty.
+
+// words returns the distinct words in a text, lowercased.
+func words(text string) []string {
+	seen := make(map[string]bool)
+	var ww []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if !seen[w] {
+			seen[w] = true
+			ww = append(ww, w)
+		}
+	}
+	return ww
+}
+
+func indexKey(word string, messageID int64) []byte {
+	return append([]byte(word+"\x00"), id2key(messageID)...)
+}
+
+func indexMessage(tx *bolt.Tx, m *tgMessage) error {
+	index := tx.Bucket(indexBucket)
+	for _, w := range words(m.Text) {
+		if err := index.Put(indexKey(w, m.ID), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexMessage(tx *bolt.Tx, m *tgMessage) {
+	index := tx.Bucket(indexBucket)
+	for _, w := range words(m.Text) {
+		_ = index.Delete(indexKey(w, m.ID))
+	}
+}
+
+// indexAllMessages builds the index for databases created before the index
+// existed.
+func indexAllMessages(tx *bolt.Tx) error {
+	return tx.Bucket(messagesBucket).ForEach(func(_, v []byte) error {
+		var m tgMessage
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		return indexMessage(tx, &m)
+	})
+}
+
+// search returns the ids of the messages containing all the words in the
+// query, in ascending order.
+func (a *account) search(query string) []int64 {
+	var ids []int64
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		var matches map[int64]bool
+		c := tx.Bucket(indexBucket).Cursor()
+		for _, w := range words(query) {
+			prefix := []byte(w + "\x00")
+			found := make(map[int64]bool)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := key2id(k[len(prefix):])
+				if matches == nil || matches[id] {
+					found[id] = true
+				}
+			}
+			matches = found
+		}
+		for id := range matches {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// fillResults adds copies of the files of the given messages to dir. Their
+// names are prefixed with the chat handle, and if the message file is not
+// directly within the chat directory, with its path within the chat directory
+// too, with slashes replaced by dashes.
+func (a *account) fillResults(dir *srv.File, messageIDs []int64) {
+	for _, id := range messageIDs {
+		m := a.findMessage(id)
+		if m == nil {
+			continue
+		}
+		chat := a.findChat(m.chatID)
+		if chat == nil {
+			continue
+		}
+		name := chat.Name + "-" + strings.Replace(relativePath(m.file, chat), "/", "-", -1)
+		f := newFile()
+		_ = f.Add(dir, name, user, group, 0666, messageCopyOps{m})
+		f.Mtime = m.file.Mtime
+		f.Atime = m.file.Atime
+	}
+}
+
+// searchOps is the file system node for the "search" directory in the root
+// directory. Walking to "search/QUERY" gives a directory of the messages
+// matching the query, which is not listed in the "search" directory.
+type searchOps struct {
+	dirOps
+	a *account
+}
+
+// Lookup implements nodes.FLookupOp.
+func (s *searchOps) Lookup(dir *srv.File, name string) *srv.File {
+	if len(words(name)) == 0 {
+		return nil
+	}
+	results := newFile()
+	nodes.AddHidden(results, dir, name, user, group, p.DMDIR|0555, dirOps{})
+	s.a.fillResults(results, s.a.search(name))
+	return results
+}
+
+// searchCtlOps is the file system node for "search/ctl". Writing a query to it
+// replaces the contents of "search/results" with the matching messages.
+// Reading it returns the last query.
+type searchCtlOps struct {
+	a       *account
+	results *srv.File
+
+	mu    sync.Mutex
+	query string
+}
+
+// Wstat implements srv.FWstatOp, to allow opening with truncation.
+func (c *searchCtlOps) Wstat(*srv.FFid, *p.Dir) error {
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (c *searchCtlOps) Read(_ *srv.FFid, buf []byte, offset uint64) (int, error) {
+	c.mu.Lock()
+	b := []byte(c.query + "\n")
+	c.mu.Unlock()
+	if offset >= uint64(len(b)) {
+		return 0, nil
+	}
+	return copy(buf, b[offset:]), nil
+}
+
+// Write implements srv.FWriteOp. Each write must contain a whole query.
+func (c *searchCtlOps) Write(_ *srv.FFid, data []byte, _ uint64) (int, error) {
+	query := strings.TrimSpace(string(data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.query = query
+	// Replace the results directory, to list only the new results.
+	c.results.Remove()
+	fresh := newFile()
+	_ = fresh.Add(c.results.Parent, "results", user, group, p.DMDIR|0555, dirOps{})
+	c.results = fresh
+	c.a.fillResults(fresh, c.a.search(query))
+	return len(data), nil
+}
+
+// addSearch adds the "search" directory to the root directory of the account.
+func (a *account) addSearch() {
+	dir := newFile()
+	_ = dir.Add(a.root, "search", user, group, p.DMDIR|0777, &searchOps{a: a})
+	results := newFile()
+	_ = results.Add(dir, "results", user, group, p.DMDIR|0555, dirOps{})
+	_ = newFile().Add(dir, "ctl", user, group, 0666, &searchCtlOps{a: a, results: results})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestWords(t *testing.T) {
+	got := words("Hello, hello world! It's 9am—ça va?")
+	want := []string{"hello", "world", "it", "s", "9am", "ça", "va"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := words(" -- "); len(got) != 0 {
+		t.Errorf("got %q, want no words", got)
+	}
+}
+
+// addTextMessage adds an incoming message to chat 42, as if Telegram had sent
+// it.
+func addTextMessage(t *testing.T, a *account, id int64, text string) {
+	t.Helper()
+	a.handleUpdateNewMessage(mustDocument(t, fmt.Sprintf(`{"message": {"@type": "message", "id": %d, "chat_id": 42, "date": %d, "content": {"text": {"text": %q}}}}`, id, 1600000000+id, text)))
+}
+
+func TestSearch(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	config = &tgConfig{}
+	addTextMessage(t, a, 1, "hi there")
+	addTextMessage(t, a, 2, "over the hill")
+	addTextMessage(t, a, 3, "Hi, how are you over there?")
+	for _, c := range []struct {
+		query string
+		want  []int64
+	}{
+		{"hi", []int64{1, 3}},
+		{"HI there", []int64{1, 3}},
+		{"over there", []int64{3}},
+		{"hill", []int64{2}},
+		{"hi hill", nil},
+		{"nothing", nil},
+	} {
+		if got := a.search(c.query); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	// Sent messages are found by their final id.
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 1048577, "chat_id": 42, "is_outgoing": true, "date": 1600000100, "content": {"text": {"text": "see you there"}}}}`))
+	a.handleUpdateMessageSendSucceeded(mustDocument(t, `{"old_message_id": 1048577, "message": {"id": 2097152, "chat_id": 42}}`))
+	if got, want := a.search("there"), []int64{1, 3, 2097152}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIndexAllMessages(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		for _, m := range []tgMessage{
+			{ID: 1, ChatID: 42, Text: "good morning"},
+			{ID: 2, ChatID: 42, Text: "good night"},
+		} {
+			b, _ := json.Marshal(m)
+			if err := tx.Bucket(messagesBucket).Put(id2key(m.ID), b); err != nil {
+				return err
+			}
+		}
+		return indexAllMessages(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.search("good"), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := a.search("night"), []int64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSearchFiles(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	config = &tgConfig{}
+	a.addSearch()
+	addTextMessage(t, a, 1, "lunch today?")
+	addTextMessage(t, a, 2, "lunch tomorrow")
+	dir := a.root.Find("search")
+
+	results := dir.Ops.(*searchOps).Lookup(dir, "lunch today")
+	if results.Find("42-1600000001.txt") == nil || results.Find("42-1600000002.txt") != nil {
+		t.Error(`"search/lunch today" doesn't have just the first message`)
+	}
+	if dir.Ops.(*searchOps).Lookup(dir, "?!") != nil {
+		t.Error("got results for a query without words")
+	}
+
+	ctl := dir.Find("ctl").Ops.(*searchCtlOps)
+	if _, err := ctl.Write(nil, []byte("lunch\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	results = dir.Find("results")
+	if results.Find("42-1600000001.txt") == nil || results.Find("42-1600000002.txt") == nil {
+		t.Error(`"search/results" doesn't have both messages`)
+	}
+	if _, err := ctl.Write(nil, []byte("tomorrow"), 0); err != nil {
+		t.Fatal(err)
+	}
+	results = dir.Find("results")
+	if results.Find("42-1600000001.txt") != nil || results.Find("42-1600000002.txt") == nil {
+		t.Error(`"search/results" doesn't have just the second message`)
+	}
+	buf := make([]byte, 100)
+	n, _ := ctl.Read(nil, buf, 0)
+	if got := string(buf[:n]); got != "tomorrow\n" {
+		t.Errorf("got query %q, want %q", got, "tomorrow\n")
+	}
+}
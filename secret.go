@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tgSecretChat is what we know about a secret chat. It is stored in the secret
+// chats bucket in JSON format.
+type tgSecretChat struct {
+	ID     int64 // The secret chat id, not the chat id.
+	ChatID int64 // Zero until we learn about the chat.
+	UserID int64
+	State  string // "pending", "ready", or "closed".
+	Handle string // The directory name, empty until we create it.
+}
+
+func getSecretChat(tx *bolt.Tx, id int64) *tgSecretChat {
+	v := tx.Bucket(secretBucket).Get(id2key(id))
+	if v == nil {
+		return nil
+	}
+	var s tgSecretChat
+	if err := json.Unmarshal(v, &s); err != nil {
+		log.Printf("Could not decode secret chat %d: %v", id, err)
+		return nil
+	}
+	return &s
+}
+
+func putSecretChat(tx *bolt.Tx, s *tgSecretChat) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(secretBucket).Put(id2key(s.ID), v); err != nil {
+		return err
+	}
+	if s.ChatID == 0 {
+		return nil
+	}
+	return tx.Bucket(secretIDBucket).Put(id2key(s.ChatID), id2key(s.ID))
+}
+
+// indexAllSecretChats maps the chat ids of secret chats to their secret chat
+// ids, for databases created before that mapping existed.
+func indexAllSecretChats(tx *bolt.Tx) error {
+	return tx.Bucket(secretBucket).ForEach(func(k, _ []byte) error {
+		s := getSecretChat(tx, key2id(k))
+		if s == nil || s.ChatID == 0 {
+			return nil
+		}
+		return tx.Bucket(secretIDBucket).Put(id2key(s.ChatID), k)
+	})
+}
+
+// findSecretChat returns the secret chat with the given chat id, or nil if the
+// chat is not a secret chat.
+func findSecretChat(tx *bolt.Tx, chatID int64) *tgSecretChat {
+	secretID := tx.Bucket(secretIDBucket).Get(id2key(chatID))
+	if secretID == nil {
+		return nil
+	}
+	return getSecretChat(tx, key2id(secretID))
+}
+
+// isSecretChat tells whether a chat is a secret chat.
+func (a *account) isSecretChat(chatID int64) bool {
+	var secret bool
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		secret = findSecretChat(tx, chatID) != nil
+		return nil
+	})
+	return secret
+}
+
+// chatHandle returns the directory name for a chat, or nil if we don't know
+// it. Private chats are named after the user, and secret chats too (see
+// secretChatHandle).
+func chatHandle(tx *bolt.Tx, chatID int64) []byte {
+	if s := findSecretChat(tx, chatID); s != nil {
+		return secretChatHandle(tx, s)
+	}
+	// The id of a private chat is the id of the user.
+	return getHandle(tx.Bucket(usersBucket), chatID)
+}
+
+// secretChatHandle returns the directory name for a secret chat. It's the
+// user's handle with a "secret-" prefix, followed by the secret chat id if
+// another chat already has that name, e.g., an older secret chat with the same
+// user. Once the directory is created, the name is kept in the secret chat.
+func secretChatHandle(tx *bolt.Tx, s *tgSecretChat) []byte {
+	if s.Handle != "" {
+		return []byte(s.Handle)
+	}
+	handle := getHandle(tx.Bucket(usersBucket), s.UserID)
+	if handle == nil {
+		handle = id2key(s.UserID)
+	}
+	handle = append([]byte("secret-"), handle...)
+	if id := tx.Bucket(chatsBucket).Get(handle); id != nil && key2id(id) != s.ChatID {
+		handle = append(handle, fmt.Sprintf("-%d", s.ID)...)
+	}
+	return handle
+}
+
+// handleNewSecretChat is used by handleUpdateNewChat to record the chat id of
+// a secret chat and create its directory, so that we can write to it before
+// any messages are exchanged.
+func (a *account) handleNewSecretChat(doc Document) {
+	if kind, _ := doc.GetString("chat.type.@type"); kind != "chatTypeSecret" {
+		return
+	}
+	chatID, _ := doc.GetInt64("chat.id")
+	secretID, _ := doc.GetInt64("chat.type.secret_chat_id")
+	userID, _ := doc.GetInt64("chat.type.user_id")
+	var s *tgSecretChat
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		s = getSecretChat(tx, secretID)
+		if s == nil {
+			s = &tgSecretChat{ID: secretID, UserID: userID}
+		}
+		s.ChatID = chatID
+		return putSecretChat(tx, s)
+	})
+	if err != nil {
+		log.Printf("Could not record secret chat %d: %v", secretID, err)
+		return
+	}
+	a.addSecretChat(s)
+}
+
+// handleUpdateSecretChat handles updateSecretChat and updateNewSecretChat,
+// which tell about the state of secret chats.
+func (a *account) handleUpdateSecretChat(doc Document) {
+	secretID, _ := doc.GetInt64("secret_chat.id")
+	userID, _ := doc.GetInt64("secret_chat.user_id")
+	state, _ := doc.GetString("secret_chat.state.@type")
+	var s *tgSecretChat
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		s = getSecretChat(tx, secretID)
+		if s == nil {
+			s = &tgSecretChat{ID: secretID, UserID: userID}
+		}
+		s.State = strings.ToLower(strings.TrimPrefix(state, "secretChatState"))
+		return putSecretChat(tx, s)
+	})
+	if err != nil {
+		log.Printf("Could not record secret chat %d: %v", secretID, err)
+		return
+	}
+	if s.ChatID != 0 {
+		a.addSecretChat(s)
+	}
+}
+
+// addSecretChat creates the directory of a secret chat if needed, and updates
+// its "state" file.
+func (a *account) addSecretChat(s *tgSecretChat) {
+	c := a.findChat(s.ChatID)
+	if c == nil {
+		var handle []byte
+		err := a.database.Update(func(tx *bolt.Tx) error {
+			handle = secretChatHandle(tx, s)
+			s.Handle = string(handle)
+			if err := putSecretChat(tx, s); err != nil {
+				return err
+			}
+			return tx.Bucket(chatsBucket).Put(handle, id2key(s.ChatID))
+		})
+		if err != nil {
+			log.Printf("Could not add secret chat %d: %v", s.ID, err)
+			return
+		}
+		c = a.addChat(string(handle), s.ChatID)
+	}
+	state := a.secretStates[s.ChatID]
+	if state == nil {
+		state = nodes.NewTextFile(nil)
+		if err := newFile().Add(c, "state", user, group, 0444, state); err != nil {
+			log.Printf("Could not add state file for secret chat %d: %v", s.ID, err)
+			return
+		}
+		a.secretStates[s.ChatID] = state
+	}
+	state.Set(textLine(s.State))
+}
+
+// messageTTL returns the self-destruct timer of a message, zero if it has none
+// or we don't know about it.
+func (a *account) messageTTL(messageID int64) int64 {
+	var m tgMessage
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(messagesBucket).Get(id2key(messageID)); v != nil {
+			return json.Unmarshal(v, &m)
+		}
+		return nil
+	})
+	return m.TTL
+}
+
+// secret starts a secret chat with the user of a private chat. Its directory
+// appears when Telegram creates the chat.
+func (c *ctlOps) secret(string) error {
+	// The id of a private chat is the id of the user.
+	_, err := c.a.query(genericMap{
+		"@type":   "createNewSecretChat",
+		"user_id": c.chatID,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create secret chat: %v", err)
+	}
+	return nil
+}
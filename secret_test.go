@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestFindSecretChat(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		if err := putSecretChat(tx, &tgSecretChat{ID: 1, UserID: 10}); err != nil {
+			return err
+		}
+		return putSecretChat(tx, &tgSecretChat{ID: 2, ChatID: 20, UserID: 10})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.isSecretChat(20) {
+		t.Error("chat 20 is not a secret chat")
+	}
+	if a.isSecretChat(10) {
+		t.Error("chat 10 is a secret chat")
+	}
+
+	// Databases created before secret chats could be found by chat id.
+	err = a.database.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(secretIDBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(secretIDBucket); err != nil {
+			return err
+		}
+		return indexAllSecretChats(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		if s := findSecretChat(tx, 20); s == nil || s.ID != 2 {
+			t.Errorf("got %+v, want secret chat 2", s)
+		}
+		return nil
+	})
+}
+
+func TestSecretChatsWithSameUser(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	for _, chat := range []string{
+		`{"chat": {"id": 1, "type": {"@type": "chatTypeSecret", "secret_chat_id": 11, "user_id": 7}}}`,
+		`{"chat": {"id": 2, "type": {"@type": "chatTypeSecret", "secret_chat_id": 12, "user_id": 7}}}`,
+	} {
+		a.handleNewSecretChat(mustDocument(t, chat))
+	}
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 100, "chat_id": 2, "date": 1600000000, "content": {"text": {"text": "hi"}}}}`))
+	for name, chatID := range map[string]int64{
+		"secret-7":    1,
+		"secret-7-12": 2,
+	} {
+		c := a.root.Find(name)
+		if c == nil {
+			t.Errorf("%q not found", name)
+			continue
+		}
+		if got := c.Ops.(*chatOps).chatID; got != chatID {
+			t.Errorf("%q: got chat %d, want %d", name, got, chatID)
+		}
+		if c.Find("state") == nil {
+			t.Errorf("%q has no state file", name)
+		}
+	}
+	if m := a.findMessage(100); m == nil || m.file.Parent.Name != "secret-7-12" {
+		t.Errorf("got message %+v, want it in secret-7-12", m)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+)
+
+// The "status" file of the file system root when serving several accounts,
+// with the status of each, and the accounts. It is nil when serving a single
+// account, whose own "status" file is at the root.
+var (
+	rootStatusMu   sync.Mutex
+	rootStatus     *nodes.TextFile
+	statusAccounts []*account
+)
+
+// addRootStatus adds the "status" file to the file system root, when serving
+// several accounts. It has a line per account, with the name of the account
+// and its status (see status), separated by a tab.
+func addRootStatus(root *srv.File, accounts []*account) {
+	rootStatus = nodes.NewTextFile(nil)
+	statusAccounts = accounts
+	_ = newFile().Add(root, "status", user, group, 0444, rootStatus)
+	refreshRootStatus()
+}
+
+func refreshRootStatus() {
+	rootStatusMu.Lock()
+	defer rootStatusMu.Unlock()
+	if rootStatus == nil {
+		return
+	}
+	var b bytes.Buffer
+	for _, a := range statusAccounts {
+		fmt.Fprintf(&b, "%s\t%s\n", a.name, a.status())
+	}
+	rootStatus.Set(b.Bytes())
+}
+
+// status returns "ready" if we can send messages right away. Otherwise, it
+// returns the authorization state if not authorized, e.g., "wait-code" or
+// "closed", or else the connection state, e.g., "connecting" or
+// "waiting-for-network".
+func (a *account) status() string {
+	a.outboxMu.Lock()
+	defer a.outboxMu.Unlock()
+	switch {
+	case a.connected && a.authorized:
+		return "ready"
+	case !a.authorized:
+		return a.authorization
+	default:
+		return a.connection
+	}
+}
+
+// refreshStatus updates the "status" files of the account and of the root.
+func (a *account) refreshStatus() {
+	a.statusFile.Set([]byte(a.status() + "\n"))
+	refreshRootStatus()
+}
+
+// checkAuthorized returns an error unless tdlib is authorized, and so can
+// accept messages to send. Messages are accepted while offline, though, and
+// sent when back online (see outbox.go).
+func (a *account) checkAuthorized() error {
+	a.outboxMu.Lock()
+	defer a.outboxMu.Unlock()
+	if a.authorized {
+		return nil
+	}
+	return fmt.Errorf("not logged in to Telegram (%s)", a.authorization)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	bolt "go.etcd.io/bbolt"
+)
+
+// topicKey identifies a forum topic within a supergroup.
+type topicKey struct {
+	chatID   int64
+	threadID int64
+}
+
+// topicOps is the file system node for a directory of messages that belong to
+// a single forum topic within a chat.
+type topicOps struct {
+	a        *account
+	chatID   int64
+	threadID int64
+}
+
+// Lookup implements nodes.FLookupOp.
+func (t *topicOps) Lookup(dir *srv.File, name string) *srv.File {
+	return lookup(dir, name)
+}
+
+// Remove allows removing a topic directory as part of removing its chat.
+func (t *topicOps) Remove(f *srv.FFid) error {
+	key := topicKey{chatID: t.chatID, threadID: t.threadID}
+	t.a.chatDirsMu.Lock()
+	if t.a.topicDirs[key] == f.F {
+		delete(t.a.topicDirs, key)
+	}
+	t.a.chatDirsMu.Unlock()
+	return nil
+}
+
+// findTopic returns the directory for the given forum topic, or nil if there
+// is none.
+func (a *account) findTopic(key topicKey) *srv.File {
+	a.chatDirsMu.Lock()
+	defer a.chatDirsMu.Unlock()
+	return a.topicDirs[key]
+}
+
+// reservedTopicNames are the names of files in chat directories (see addChat
+// and getLayout), which topic directories can't have.
+var reservedTopicNames = map[string]bool{
+	".":         true,
+	"..":        true,
+	"in":        true,
+	"out":       true,
+	"out.json":  true,
+	"unread":    true,
+	"pending":   true,
+	"scheduled": true,
+	"draft":     true,
+	"action":    true,
+	"members":   true,
+	"pinned":    true,
+	"ctl":       true,
+	"latest":    true,
+	"today":     true,
+}
+
+// topicDir returns the directory for the given forum topic within the chat
+// directory, creating it if necessary. Topic directories are named after the
+// topic (see topicDirName) and can therefore be renamed.
+func (a *account) topicDir(tx *bolt.Tx, chat *srv.File, chatID int64, threadID int64) *srv.File {
+	if chat == nil {
+		return nil
+	}
+	key := topicKey{chatID: chatID, threadID: threadID}
+	if t := a.findTopic(key); t != nil {
+		return t
+	}
+	t := newFile()
+	if err := t.Add(chat, topicDirName(tx, chat, nil, chatID, threadID), user, group, p.DMDIR|0777, &topicOps{a: a, chatID: chatID, threadID: threadID}); err != nil {
+		log.Printf("Could not add topic %d to chat %d: %v", threadID, chatID, err)
+		return chat
+	}
+	_ = newFile().Add(t, "in", user, group, 0666, newInOps(a, chatID, threadID))
+	a.addOutFiles(t, chatID)
+	a.chatDirsMu.Lock()
+	a.topicDirs[key] = t
+	a.chatDirsMu.Unlock()
+	return t
+}
+
+// topicName returns the directory name for a topic, falling back to the
+// thread id until we learn the topic name.
+func topicName(tx *bolt.Tx, chatID int64, threadID int64) string {
+	if name := tx.Bucket(topicsBucket).Get(topicBucketKey(chatID, threadID)); name != nil {
+		return string(name)
+	}
+	return fmt.Sprintf("%d", threadID)
+}
+
+// topicDirName returns the name for the directory t of a topic within the
+// chat directory, nil if it doesn't exist yet. It's the topic name (see
+// topicName), followed by the thread id if the name is reserved (see
+// reservedTopicNames) or taken by another file.
+func topicDirName(tx *bolt.Tx, chat *srv.File, t *srv.File, chatID int64, threadID int64) string {
+	name := topicName(tx, chatID, threadID)
+	if f := chat.Find(name); !reservedTopicNames[name] && (f == nil || f == t) {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, threadID)
+}
+
+func putTopicName(tx *bolt.Tx, chatID int64, threadID int64, name string) error {
+	handle := toHandle(name)
+	if handle == "" {
+		return nil
+	}
+	return tx.Bucket(topicsBucket).Put(topicBucketKey(chatID, threadID), []byte(handle))
+}
+
+func topicBucketKey(chatID int64, threadID int64) []byte {
+	return []byte(fmt.Sprintf("%d/%d", chatID, threadID))
+}
+
+// The forum topic info updates are used to maintain the names of topic
+// directories.
+func (a *account) handleUpdateForumTopicInfo(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	threadID, ok := doc.GetInt64("info.message_thread_id")
+	if !ok {
+		log.Print("Could not get topic thread id")
+		return
+	}
+	name, _ := doc.GetString("info.name")
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		if err := putTopicName(tx, chatID, threadID, name); err != nil {
+			return err
+		}
+		if t := a.findTopic(topicKey{chatID: chatID, threadID: threadID}); t != nil {
+			if newName := topicDirName(tx, t.Parent, t, chatID, threadID); t.Name != newName {
+				return t.Rename(newName)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not handle forum topic info update: %v", err)
+	}
+}
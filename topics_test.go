@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTopicDirNames(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	config = &tgConfig{}
+	// Topics are created by messages, which are the first of their threads.
+	for _, topic := range []struct {
+		id   int64
+		name string
+	}{
+		{10, "In"},
+		{11, "news"},
+		{12, "News"},
+	} {
+		a.handleUpdateNewMessage(mustDocument(t, fmt.Sprintf(`{"message": {"@type": "message", "id": %d, "chat_id": 42, "date": 1600000000, "content": {"@type": "messageForumTopicCreated", "name": %q}}}`, topic.id, topic.name)))
+	}
+	c := a.findChat(42)
+	if c == nil {
+		t.Fatal("no chat directory")
+	}
+	if _, ok := c.Find("in").Ops.(*inOps); !ok {
+		t.Error(`"in" is not the chat's in file`)
+	}
+	for name, threadID := range map[string]int64{"in-10": 10, "news": 11, "news-12": 12} {
+		dir := c.Find(name)
+		if dir == nil {
+			t.Errorf("%q not found", name)
+			continue
+		}
+		if got := dir.Ops.(*topicOps).threadID; got != threadID {
+			t.Errorf("%q: got thread %d, want %d", name, got, threadID)
+		}
+		if m := a.findMessage(threadID); m == nil || m.file.Parent != dir {
+			t.Errorf("message %d not in %q", threadID, name)
+		}
+	}
+
+	a.handleUpdateForumTopicInfo(mustDocument(t, `{"chat_id": 42, "info": {"message_thread_id": 10, "name": "ctl"}}`))
+	if dir := c.Find("ctl-10"); dir == nil || dir.Ops.(*topicOps).threadID != 10 {
+		t.Errorf(`got %v for "ctl-10", want the directory of topic 10`, dir)
+	}
+	if _, ok := c.Find("ctl").Ops.(*ctlOps); !ok {
+		t.Error(`"ctl" is not the chat's ctl file`)
+	}
+	// Renaming to the current name keeps it.
+	a.handleUpdateForumTopicInfo(mustDocument(t, `{"chat_id": 42, "info": {"message_thread_id": 10, "name": "ctl"}}`))
+	if c.Find("ctl-10") == nil {
+		t.Error(`"ctl-10" not found`)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// readState is what we know about read messages in a chat, as reported by
+// Telegram.
+type readState struct {
+	unreadCount    int64
+	lastReadInbox  int64 // Last incoming message we have read.
+	lastReadOutbox int64 // Last outgoing message the peer has read.
+}
+
+// chatMessageIDs are the ids of the incoming and outgoing messages of a chat,
+// which refreshUnread uses to find the first unread and the last seen message.
+type chatMessageIDs struct {
+	incoming sortedIDs
+	outgoing sortedIDs
+}
+
+// sortedIDs is a set of message ids, in ascending order.
+type sortedIDs []int64
+
+// search returns the index of the first id not smaller than id.
+func (ids sortedIDs) search(id int64) int {
+	return sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+}
+
+// add adds an id, and returns the resulting set and the index of the id.
+func (ids sortedIDs) add(id int64) (sortedIDs, int) {
+	i := ids.search(id)
+	if i < len(ids) && ids[i] == id {
+		return ids, i
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids, i
+}
+
+// remove removes an id, and returns the resulting set and the index the id
+// had, or -1 if it was not in the set.
+func (ids sortedIDs) remove(id int64) (sortedIDs, int) {
+	i := ids.search(id)
+	if i == len(ids) || ids[i] != id {
+		return ids, -1
+	}
+	return append(ids[:i], ids[i+1:]...), i
+}
+
+// indexMessage adds a message to the ids of its chat. The caller must hold
+// a.msgNodesMu.
+func (a *account) indexMessage(m *messageOps) {
+	ids := a.chatMessages[m.chatID]
+	if ids == nil {
+		ids = &chatMessageIDs{}
+		a.chatMessages[m.chatID] = ids
+	}
+	if m.isOutgoing {
+		ids.outgoing, _ = ids.outgoing.add(m.messageID)
+	} else {
+		ids.incoming, _ = ids.incoming.add(m.messageID)
+	}
+}
+
+// unindexMessage removes a message from the ids of its chat. The caller must
+// hold a.msgNodesMu.
+func (a *account) unindexMessage(m *messageOps) {
+	ids := a.chatMessages[m.chatID]
+	if ids == nil {
+		return
+	}
+	if m.isOutgoing {
+		ids.outgoing, _ = ids.outgoing.remove(m.messageID)
+	} else {
+		ids.incoming, _ = ids.incoming.remove(m.messageID)
+	}
+	if len(ids.incoming) == 0 && len(ids.outgoing) == 0 {
+		delete(a.chatMessages, m.chatID)
+	}
+}
+
+func (a *account) getReadState(chatID int64) *readState {
+	rs := a.readStates[chatID]
+	if rs == nil {
+		rs = &readState{}
+		a.readStates[chatID] = rs
+	}
+	return rs
+}
+
+func (a *account) handleUpdateNewChat(doc Document) {
+	chatID, _ := doc.GetInt64("chat.id")
+	rs := a.getReadState(chatID)
+	rs.unreadCount, _ = doc.GetInt64("chat.unread_count")
+	rs.lastReadInbox, _ = doc.GetInt64("chat.last_read_inbox_message_id")
+	rs.lastReadOutbox, _ = doc.GetInt64("chat.last_read_outbox_message_id")
+	a.refreshUnread(chatID)
+	a.setDraft(chatID, doc, "chat.draft_message")
+	a.handleNewSecretChat(doc)
+	if pinned, _ := doc.GetInt64("chat.pinned_message_id"); pinned != 0 {
+		// Older tdlib versions.
+		a.setPinned(chatID, pinned, true)
+	}
+	if has, _ := doc.GetBool("chat.has_scheduled_messages"); has {
+		a.loadScheduled(chatID)
+	}
+}
+
+func (a *account) handleUpdateChatReadInbox(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	rs := a.getReadState(chatID)
+	rs.unreadCount, _ = doc.GetInt64("unread_count")
+	lastRead, _ := doc.GetInt64("last_read_inbox_message_id")
+	if lastRead != rs.lastReadInbox {
+		rs.lastReadInbox = lastRead
+		a.emitEvent("read", chatID, lastRead, a.messageSender(lastRead))
+	}
+	a.refreshUnread(chatID)
+}
+
+func (a *account) handleUpdateChatReadOutbox(doc Document) {
+	chatID, _ := doc.GetInt64("chat_id")
+	rs := a.getReadState(chatID)
+	lastRead, _ := doc.GetInt64("last_read_outbox_message_id")
+	if lastRead != rs.lastReadOutbox {
+		rs.lastReadOutbox = lastRead
+		a.emitEvent("seen", chatID, lastRead, a.messageSender(lastRead))
+	}
+	a.refreshUnread(chatID)
+}
+
+// refreshUnread updates the "unread" file of the given chat and the one in the
+// root directory of the account.
+//
+// The chat's file contains the number of unread messages followed by the path
+// of the first unread message file, if known. A second line contains "seen"
+// followed by the path of the last outgoing message read by the peer, if
+// known; all outgoing messages up to that one have been read. Paths are
+// relative to the chat directory.
+func (a *account) refreshUnread(chatID int64) {
+	rs := a.readStates[chatID]
+	if rs == nil {
+		return
+	}
+	if c := a.findChat(chatID); c != nil {
+		var firstUnread, lastSeen *messageOps
+		a.msgNodesMu.Lock()
+		if ids := a.chatMessages[chatID]; ids != nil {
+			if i := ids.incoming.search(rs.lastReadInbox + 1); i < len(ids.incoming) {
+				firstUnread = a.msgNodes[ids.incoming[i]]
+			}
+			if i := ids.outgoing.search(rs.lastReadOutbox + 1); i > 0 {
+				lastSeen = a.msgNodes[ids.outgoing[i-1]]
+			}
+		}
+		a.msgNodesMu.Unlock()
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%d", rs.unreadCount)
+		if firstUnread != nil && rs.unreadCount > 0 {
+			fmt.Fprintf(&b, " %s", relativePath(firstUnread.file, c))
+		}
+		b.WriteByte('\n')
+		if lastSeen != nil {
+			fmt.Fprintf(&b, "seen %s\n", relativePath(lastSeen.file, c))
+		}
+		c.Ops.(*chatOps).unread.Set(b.Bytes())
+	}
+	a.refreshRootUnread()
+}
+
+// refreshRootUnread lists chats with unread messages, one per line, as a
+// handle and the number of unread messages separated by a tab.
+func (a *account) refreshRootUnread() {
+	var lines []string
+	for chatID, rs := range a.readStates {
+		if rs.unreadCount <= 0 {
+			continue
+		}
+		handle := fmt.Sprintf("%d", chatID)
+		if c := a.findChat(chatID); c != nil {
+			handle = c.Name
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%d\n", handle, rs.unreadCount))
+	}
+	sort.Strings(lines)
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+	a.rootUnread.Set(b.Bytes())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortedIDs(t *testing.T) {
+	var ids sortedIDs
+	for _, id := range []int64{5, 1, 3, 3} {
+		ids, _ = ids.add(id)
+	}
+	if want := (sortedIDs{1, 3, 5}); !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	ids, i := ids.remove(3)
+	if want := (sortedIDs{1, 5}); i != 1 || !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v (index %d), want %v (index 1)", ids, i, want)
+	}
+	if _, i := ids.remove(4); i != -1 {
+		t.Errorf("got index %d removing a missing id, want -1", i)
+	}
+}
+
+func TestIndexMessage(t *testing.T) {
+	a := &account{chatMessages: make(map[int64]*chatMessageIDs)}
+	messages := []*messageOps{
+		{chatID: 1, messageID: 10},
+		{chatID: 1, messageID: 11, isOutgoing: true},
+		{chatID: 1, messageID: 12},
+		{chatID: 2, messageID: 13},
+	}
+	for _, m := range messages {
+		a.indexMessage(m)
+	}
+	ids := a.chatMessages[1]
+	if !reflect.DeepEqual(ids.incoming, sortedIDs{10, 12}) || !reflect.DeepEqual(ids.outgoing, sortedIDs{11}) {
+		t.Errorf("got %+v", ids)
+	}
+	a.unindexMessage(messages[3])
+	if a.chatMessages[2] != nil {
+		t.Errorf("got %+v, want no ids for chat 2", a.chatMessages[2])
+	}
+}
+
+func TestUnreadAfterRenumber(t *testing.T) {
+	a, cleanup := newTestAccount(t)
+	defer cleanup()
+	a.handleUpdateNewMessage(mustDocument(t, `{"message": {"@type": "message", "id": 1048577, "chat_id": 42, "is_outgoing": true, "date": 1600000000, "content": {"text": {"text": "hi"}}}}`))
+	a.handleUpdateMessageSendSucceeded(mustDocument(t, `{"old_message_id": 1048577, "message": {"id": 2097152, "chat_id": 42}}`))
+	a.handleUpdateChatReadOutbox(mustDocument(t, `{"chat_id": 42, "last_read_outbox_message_id": 2097152}`))
+	c := a.findChat(42)
+	if c == nil {
+		t.Fatal("no chat directory")
+	}
+	got := string(c.Ops.(*chatOps).unread.Bytes())
+	if want := "0\nseen 1600000000.txt\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if ids := a.chatMessages[42]; !reflect.DeepEqual(ids.outgoing, sortedIDs{2097152}) {
+		t.Errorf("got outgoing ids %v, want [2097152]", ids.outgoing)
+	}
+}
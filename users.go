@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/telegramfs/internal/nodes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tgUser is what we know about a Telegram user. It is stored in the users
+// bucket in JSON format. Older databases have just the handle instead.
+type tgUser struct {
+	ID        int64
+	Handle    string
+	FirstName string `json:",omitempty"`
+	LastName  string `json:",omitempty"`
+	Username  string `json:",omitempty"`
+	Phone     string `json:",omitempty"`
+	Status    string `json:",omitempty"`
+	Bio       string `json:",omitempty"`
+}
+
+// getUser returns the user with the given id from the users bucket, or nil if
+// there is none.
+func getUser(users *bolt.Bucket, id int64) *tgUser {
+	v := users.Get(id2key(id))
+	if v == nil {
+		return nil
+	}
+	var u tgUser
+	if bytes.HasPrefix(v, []byte("{")) {
+		if err := json.Unmarshal(v, &u); err != nil {
+			log.Printf("Could not decode user %d: %v", id, err)
+			return nil
+		}
+		return &u
+	}
+	u.ID = id
+	u.Handle = string(v)
+	return &u
+}
+
+// getHandle returns the handle of the user with the given id, or nil if the
+// user is not known.
+func getHandle(users *bolt.Bucket, id int64) []byte {
+	if u := getUser(users, id); u != nil {
+		return []byte(u.Handle)
+	}
+	return nil
+}
+
+// userHandle looks up the handle of a user in the database, falling back to
+// the user id.
+func (a *account) userHandle(userID int64) string {
+	handle := fmt.Sprintf("%d", userID)
+	_ = a.database.View(func(tx *bolt.Tx) error {
+		if h := getHandle(tx.Bucket(usersBucket), userID); h != nil {
+			handle = string(h)
+		}
+		return nil
+	})
+	return handle
+}
+
+func putUser(users *bolt.Bucket, u *tgUser) error {
+	v, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return users.Put(id2key(u.ID), v)
+}
+
+// updateUser applies change to the stored user with the given id, if there is
+// one, and updates its directory.
+func (a *account) updateUser(id int64, change func(u *tgUser)) {
+	var u *tgUser
+	err := a.database.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		if u = getUser(users, id); u == nil {
+			return nil
+		}
+		change(u)
+		return putUser(users, u)
+	})
+	if err != nil {
+		log.Printf("Could not update user %d: %v", id, err)
+		return
+	}
+	if u != nil {
+		a.addUserDir(u)
+	}
+}
+
+// statusString describes the user status found at the given path in doc,
+// e.g., "online", "last seen 2026-10-17T09:00:00Z", or "recently".
+func statusString(doc Document, path string) string {
+	kind, _ := doc.GetString(path + ".@type")
+	switch kind {
+	case "userStatusOnline":
+		return "online"
+	case "userStatusOffline":
+		wasOnline, _ := doc.GetInt64(path + ".was_online")
+		return "last seen " + time.Unix(wasOnline, 0).Format(time.RFC3339)
+	case "userStatusRecently":
+		return "recently"
+	case "userStatusLastWeek":
+		return "last week"
+	case "userStatusLastMonth":
+		return "last month"
+	}
+	return ""
+}
+
+func (a *account) handleUpdateUserStatus(doc Document) {
+	id, _ := doc.GetInt64("user_id")
+	status := statusString(doc, "status")
+	a.updateUser(id, func(u *tgUser) {
+		u.Status = status
+	})
+}
+
+func (a *account) handleUpdateUserFullInfo(doc Document) {
+	id, _ := doc.GetInt64("user_id")
+	bio := fullInfoBio(doc, "user_full_info.")
+	a.updateUser(id, func(u *tgUser) {
+		u.Bio = bio
+	})
+}
+
+// fullInfoBio returns the bio in the userFullInfo object whose keys in doc have
+// the given prefix. The bio is a string in older tdlib versions, and formatted
+// text in newer ones.
+func fullInfoBio(doc Document, prefix string) string {
+	if bio, ok := doc.GetString(prefix + "bio"); ok {
+		return bio
+	}
+	bio, _ := doc.GetString(prefix + "bio.text")
+	return bio
+}
+
+// userOps is the file system node for the directory of a user within the
+// "users" directory.
+type userOps struct {
+	dirOps
+	name     *nodes.TextFile
+	username *nodes.TextFile
+	phone    *nodes.TextFile
+	status   *nodes.TextFile
+	bio      *bioOps
+}
+
+// bioOps is the file system node for the bio of a user, which tdlib only
+// knows about once asked for it. It is asked for whenever the file is opened.
+type bioOps struct {
+	*nodes.TextFile
+	a      *account
+	userID int64
+}
+
+// Open implements srv.FOpenOp.
+func (b *bioOps) Open(*srv.FFid, uint8) error {
+	doc, err := b.a.query(genericMap{
+		"@type":   "getUserFullInfo",
+		"user_id": b.userID,
+	})
+	if err != nil {
+		// Serve what we know.
+		log.Printf("Could not get full info of user %d: %v", b.userID, err)
+		return nil
+	}
+	bio := fullInfoBio(doc, "")
+	b.Set(textLine(bio))
+	return nil
+}
+
+// chatLinkOps is the file system node for the "chat" file of a user, which
+// contains the name of the directory of the private chat with the user, if
+// there is one.
+type chatLinkOps struct {
+	a      *account
+	userID int64
+}
+
+func (c chatLinkOps) contents() []byte {
+	// The id of a private chat is the id of the user.
+	if chat := c.a.findChat(c.userID); chat != nil {
+		return textLine(chat.Name)
+	}
+	return nil
+}
+
+// Stat implements srv.FStatOp.
+func (c chatLinkOps) Stat(fid *srv.FFid) error {
+	fid.F.Length = uint64(len(c.contents()))
+	return nil
+}
+
+// Read implements srv.FReadOp.
+func (c chatLinkOps) Read(_ *srv.FFid, buf []byte, offset uint64) (int, error) {
+	b := c.contents()
+	if offset >= uint64(len(b)) {
+		return 0, nil
+	}
+	return copy(buf, b[offset:]), nil
+}
+
+// textLine returns s followed by a newline, or nothing if s is empty.
+func textLine(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s + "\n")
+}
+
+// addUsers adds the "users" directory to the root directory of the account,
+// with a directory for each user in the database.
+func (a *account) addUsers() {
+	a.usersDir = newFile()
+	_ = a.usersDir.Add(a.root, "users", user, group, p.DMDIR|0555, dirOps{})
+	var uu []*tgUser
+	err := a.database.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		return users.ForEach(func(k, _ []byte) error {
+			if u := getUser(users, key2id(k)); u != nil {
+				uu = append(uu, u)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Could not add users: %v", err)
+	}
+	for _, u := range uu {
+		a.addUserDir(u)
+	}
+}
+
+// addUserDir creates or updates the directory of a user. It is named after
+// the user's handle, and if that is taken, the user id too.
+func (a *account) addUserDir(u *tgUser) {
+	name := u.Handle
+	if other := a.usersDir.Find(name); other != nil && other != a.userDirs[u.ID] {
+		name = fmt.Sprintf("%s-%d", u.Handle, u.ID)
+	}
+	d := a.userDirs[u.ID]
+	if d == nil {
+		ops := &userOps{
+			name:     nodes.NewTextFile(nil),
+			username: nodes.NewTextFile(nil),
+			phone:    nodes.NewTextFile(nil),
+			status:   nodes.NewTextFile(nil),
+			bio:      &bioOps{TextFile: nodes.NewTextFile(nil), a: a, userID: u.ID},
+		}
+		d = newFile()
+		if err := d.Add(a.usersDir, name, user, group, p.DMDIR|0555, ops); err != nil {
+			log.Printf("Could not add directory for user %d: %v", u.ID, err)
+			return
+		}
+		_ = newFile().Add(d, "name", user, group, 0444, ops.name)
+		_ = newFile().Add(d, "username", user, group, 0444, ops.username)
+		_ = newFile().Add(d, "phone", user, group, 0444, ops.phone)
+		_ = newFile().Add(d, "status", user, group, 0444, ops.status)
+		_ = newFile().Add(d, "bio", user, group, 0444, ops.bio)
+		_ = newFile().Add(d, "chat", user, group, 0444, chatLinkOps{a: a, userID: u.ID})
+		a.userDirs[u.ID] = d
+	} else if d.Name != name {
+		if err := d.Rename(name); err != nil {
+			log.Printf("Could not rename directory for user %d: %v", u.ID, err)
+		}
+	}
+	ops := d.Ops.(*userOps)
+	ops.name.Set(textLine(strings.TrimSpace(u.FirstName + " " + u.LastName)))
+	ops.username.Set(textLine(u.Username))
+	ops.phone.Set(textLine(u.Phone))
+	ops.status.Set(textLine(u.Status))
+	ops.bio.Set(textLine(u.Bio))
+}